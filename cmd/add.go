@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/sojebsikder/go-npm/pkg"
 )
@@ -27,63 +26,76 @@ func RunAdd(args []string) {
 	}
 
 	os.MkdirAll("node_modules", 0755)
+	if err := pkg.CleanupTempDirs("node_modules"); err != nil {
+		fmt.Println("Warning: could not clean up leftovers from an earlier install:", err)
+	}
 
-	lock := make(map[string]pkg.LockedDependency)
-	devLock := make(map[string]pkg.LockedDependency)
+	deps := &pkgJSON.Dependencies
+	if *isDev {
+		deps = &pkgJSON.DevDependencies
+	}
+	if *deps == nil {
+		*deps = map[string]string{}
+	}
 
+	var specs []*pkg.PackageSpec
 	for _, arg := range pkgs {
-		var name, version string
-		parts := strings.SplitN(arg, "@", 2)
-		name = parts[0]
-		if len(parts) == 2 {
-			version = parts[1]
-		} else {
-			version = "latest"
+		spec, err := pkg.ParsePackageSpec(arg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
 		}
+		specs = append(specs, spec)
+		// Adding moves a package between dependencies and devDependencies,
+		// and out of optionalDependencies, which would otherwise win
+		delete(pkgJSON.Dependencies, spec.Name)
+		delete(pkgJSON.DevDependencies, spec.Name)
+		delete(pkgJSON.OptionalDependencies, spec.Name)
+		(*deps)[spec.Name] = spec.FetchSpec
+	}
+	if len(specs) == 0 {
+		return
+	}
 
-		if version == "latest" {
-			meta, err := pkg.FetchPackageMeta(name)
-			if err != nil {
-				fmt.Printf("Error fetching %s: %v\n", name, err)
-				continue
-			}
-			distTags, ok := meta["dist-tags"].(map[string]interface{})
-			if !ok {
-				fmt.Printf("dist-tags not found for %s\n", name)
-				continue
-			}
-			latest, ok := distTags["latest"].(string)
-			if !ok {
-				fmt.Printf("latest tag not found for %s\n", name)
-				continue
-			}
-			version = latest
-		}
+	ctx, stop := interruptContext()
+	defer stop()
 
-		if err := pkg.InstallPackage(name, version, lock, false); err != nil {
-			fmt.Printf("Failed to install %s@%s: %v\n", name, version, err)
+	lock, _ := pkg.LoadPackageLock("package-lock.json")
+	reg := pkg.NewRegistry()
+	resolver := &pkg.Resolver{Registry: reg, Lock: lock, Workers: 5}
+	graph, err := resolver.Resolve(ctx, pkgJSON)
+	if err == nil {
+		printPeerConflicts(graph)
+		printUnmetDependencies(graph)
+		err = pkg.Install(ctx, reg, graph, 5)
+		printOptionalFailures(graph)
+	}
+	if err != nil {
+		printInstallErrors([]error{err})
+		return
+	}
+
+	for _, spec := range specs {
+		// Ranges are saved as given, tags and exact versions get a caret
+		target := spec.Target()
+		node := graph.Root.Edges[spec.Name]
+		if target.Type == pkg.SpecRange || node == nil {
 			continue
 		}
-
-		if *isDev {
-			if pkgJSON.DevDependencies == nil {
-				pkgJSON.DevDependencies = map[string]string{}
-			}
-			pkgJSON.DevDependencies[name] = "^" + version
-			devLock[name] = lock[name]
-		} else {
-			if pkgJSON.Dependencies == nil {
-				pkgJSON.Dependencies = map[string]string{}
-			}
-			pkgJSON.Dependencies[name] = "^" + version
+		saved := "^" + node.Version
+		if spec.Type == pkg.SpecAlias {
+			saved = "npm:" + target.Name + "@" + saved
 		}
+		(*deps)[spec.Name] = saved
 	}
 
+	lockfile, devLock := graph.Lock()
 	pkg.SavePackageJSON("package.json", pkgJSON)
 	pkg.SavePackageLock("package-lock.json", &pkg.PackageLock{
 		Name:     pkgJSON.Name,
 		Version:  pkgJSON.Version,
-		Lockfile: lock,
+		Lockfile: lockfile,
 		DevLock:  devLock,
 	})
+	registerProject()
 }
@@ -0,0 +1,47 @@
+package cmd_test
+
+import (
+	"testing"
+
+	"github.com/sojebsikder/go-npm/cmd"
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestRunAddOverridesOptionalDependency(t *testing.T) {
+	reg := registrytest.New(t, registrytest.Package{Name: "fsev", Version: "2.0.0"})
+	t.Chdir(t.TempDir())
+	oldCfg := pkg.Cfg
+	t.Cleanup(func() { pkg.Cfg = oldCfg })
+	pkg.Cfg = pkg.NewConfig()
+	pkg.Cfg.Set("registry", reg.URL)
+	pkg.Cfg.Set("cache", t.TempDir())
+	pkg.Cfg.Set("store-dir", t.TempDir())
+
+	// The optional range matches nothing published, so it fails to resolve
+	pkg.SavePackageJSON("package.json", &pkg.PackageJSON{
+		Name:                 "app",
+		Version:              "1.0.0",
+		OptionalDependencies: map[string]string{"fsev": "^3.0.0"},
+	})
+
+	cmd.RunAdd([]string{"fsev@2.0.0"})
+
+	pkgJSON, err := pkg.LoadPackageJSON("package.json")
+	if err != nil {
+		t.Fatalf("Failed to load package.json: %v", err)
+	}
+	if got := pkgJSON.Dependencies["fsev"]; got != "^2.0.0" {
+		t.Errorf("Expected fsev saved as ^2.0.0, got %q", got)
+	}
+	if _, ok := pkgJSON.OptionalDependencies["fsev"]; ok {
+		t.Errorf("Expected fsev to be removed from optionalDependencies")
+	}
+	lock, err := pkg.LoadPackageLock("package-lock.json")
+	if err != nil {
+		t.Fatalf("Failed to load package-lock.json: %v", err)
+	}
+	if got := lock.Lockfile["fsev"].Version; got != "2.0.0" {
+		t.Errorf("Expected fsev 2.0.0 locked, got %q", got)
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -22,21 +23,25 @@ func RunCI() {
 
 	os.MkdirAll("node_modules", 0755)
 
-	for name, dep := range lock.Lockfile {
-		fmt.Println("Installing", name, dep.Version)
-		if err := pkg.InstallPackage(name, dep.Version, lock.Lockfile, true); err != nil {
-			fmt.Printf("Failed to install %s@%s: %v\n", name, dep.Version, err)
-			return
-		}
+	graph, err := pkg.LockGraph(lock)
+	if err != nil {
+		fmt.Println("Error reading package-lock.json:", err)
+		return
 	}
-
-	for name, dep := range lock.DevLock {
-		fmt.Println("Installing dev dependency", name, dep.Version)
-		if err := pkg.InstallPackage(name, dep.Version, lock.DevLock, true); err != nil {
-			fmt.Printf("Failed to install dev dependency %s@%s: %v\n", name, dep.Version, err)
-			return
-		}
+	ctx, stop := interruptContext()
+	defer stop()
+	err = pkg.Install(ctx, pkg.NewRegistry(), graph, 5)
+	printOptionalFailures(graph)
+	if err != nil {
+		printInstallErrors([]error{err})
+		return
 	}
 
+	registerProject()
 	fmt.Println("Dependencies and devDependencies installed from package-lock.json")
 }
+
+func isOfflineError(err error) bool {
+	var offlineErr *pkg.OfflineError
+	return errors.As(err, &offlineErr)
+}
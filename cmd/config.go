@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+// configFlags are accepted by every command and override .npmrc values.
+// The value tells whether the flag is a boolean that takes no argument.
+var configFlags = map[string]bool{
+	"registry":       false,
+	"prefer-online":  true,
+	"prefer-offline": true,
+	"offline":        true,
+
+	"legacy-peer-deps": true,
+	"strict-peer-deps": true,
+
+	"os":   false,
+	"cpu":  false,
+	"libc": false,
+}
+
+// LoadConfig strips the config flags from the args of command, loads the
+// .npmrc files and installs the result as pkg.Cfg. The remaining arguments
+// are returned. The arguments following the script name of run belong to
+// the script and are left alone.
+func LoadConfig(command string, args []string) ([]string, error) {
+	overrides := make(map[string]string)
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			if command == "run" {
+				rest = append(rest, args[i+1:]...)
+				break
+			}
+			continue
+		}
+
+		key, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		isBool, known := configFlags[key]
+		if !known {
+			rest = append(rest, arg)
+			continue
+		}
+
+		switch {
+		case hasValue:
+		case isBool:
+			value = "true"
+		case i+1 < len(args):
+			i++
+			value = args[i]
+		default:
+			return nil, fmt.Errorf("--%s needs a value", key)
+		}
+		overrides[key] = value
+	}
+
+	cfg, err := pkg.LoadConfig(overrides)
+	if err != nil {
+		return nil, err
+	}
+	pkg.Cfg = cfg
+	return rest, nil
+}
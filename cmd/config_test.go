@@ -0,0 +1,67 @@
+package cmd_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/cmd"
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func TestLoadConfigFlags(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("SNPM_GLOBALCONFIG", "")
+	t.Setenv("SNPM_USERCONFIG", "")
+	t.Setenv("SNPM_REGISTRY", "")
+	oldCfg := pkg.Cfg
+	t.Cleanup(func() { pkg.Cfg = oldCfg })
+
+	tests := []struct {
+		command  string
+		args     []string
+		rest     []string
+		registry string
+		offline  bool
+	}{
+		{
+			command:  "add",
+			args:     []string{"--registry", "https://flag.example", "lodash", "--offline", "--dev"},
+			rest:     []string{"lodash", "--dev"},
+			registry: "https://flag.example/",
+			offline:  true,
+		},
+		{
+			command:  "add",
+			args:     []string{"--registry=https://flag.example", "lodash"},
+			rest:     []string{"lodash"},
+			registry: "https://flag.example/",
+		},
+		{
+			command:  "run",
+			args:     []string{"--offline", "test", "--registry", "https://script.example", "--os", "linux"},
+			rest:     []string{"test", "--registry", "https://script.example", "--os", "linux"},
+			registry: "https://registry.npmjs.org/",
+			offline:  true,
+		},
+	}
+	for _, tt := range tests {
+		rest, err := cmd.LoadConfig(tt.command, tt.args)
+		if err != nil {
+			t.Errorf("LoadConfig(%q, %q) failed: %v", tt.command, tt.args, err)
+			continue
+		}
+		if !slices.Equal(rest, tt.rest) {
+			t.Errorf("LoadConfig(%q, %q) left %q, want %q", tt.command, tt.args, rest, tt.rest)
+		}
+		if got := pkg.Cfg.Registry(); got != tt.registry {
+			t.Errorf("LoadConfig(%q, %q) set registry %s, want %s", tt.command, tt.args, got, tt.registry)
+		}
+		if got := pkg.Cfg.Bool("offline"); got != tt.offline {
+			t.Errorf("LoadConfig(%q, %q) set offline %v, want %v", tt.command, tt.args, got, tt.offline)
+		}
+	}
+
+	if _, err := cmd.LoadConfig("install", []string{"--registry"}); err == nil {
+		t.Errorf("Expected an error for --registry without a value")
+	}
+}
@@ -1,20 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"sync"
+	"os/signal"
+	"slices"
+	"sort"
 
 	"github.com/sojebsikder/go-npm/pkg"
 )
 
-// job struct to pass through the channel
-type installJob struct {
-	name    string
-	version string
-	lockMap map[string]pkg.LockedDependency
-}
-
 func RunInstall(pkgPath string) {
 	pkgJSON, err := pkg.LoadPackageJSON(pkgPath)
 	if err != nil {
@@ -25,65 +22,127 @@ func RunInstall(pkgPath string) {
 	fmt.Printf("Installing from %s\n", pkgPath)
 
 	os.MkdirAll("node_modules", 0755)
-
-	lock := &pkg.PackageLock{
-		Name:     pkgJSON.Name,
-		Version:  pkgJSON.Version,
-		Lockfile: make(map[string]pkg.LockedDependency),
-		DevLock:  make(map[string]pkg.LockedDependency),
+	if err := pkg.CleanupTempDirs("node_modules"); err != nil {
+		fmt.Println("Warning: could not clean up leftovers from an earlier install:", err)
 	}
 
-	// Setup Worker Pool
-	const numWorkers = 5 // Limit concurrent downloads
-	jobs := make(chan installJob)
-	errs := make(chan error, 1000) // Buffer to prevent blocking
-	var wg sync.WaitGroup
-
-	// Start workers
-	for w := 1; w <= numWorkers; w++ {
-		go func() {
-			for job := range jobs {
-				if err := pkg.InstallPackage(job.name, job.version, job.lockMap, false); err != nil {
-					errs <- fmt.Errorf("error installing %s: %w", job.name, err)
-				}
-				wg.Done()
-			}
-		}()
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// An existing lockfile keeps the versions it records
+	lock, _ := pkg.LoadPackageLock("package-lock.json")
+	reg := pkg.NewRegistry()
+	const numWorkers = 5 // Limit concurrent requests
+
+	fmt.Println("Resolving dependencies...")
+	resolver := &pkg.Resolver{Registry: reg, Lock: lock, Workers: numWorkers}
+	graph, err := resolver.Resolve(ctx, pkgJSON)
+	if err != nil && !isOfflineError(err) {
+		printInstallErrors([]error{err})
+		return
 	}
 
-	// Queue Top-level Dependencies
-	queueDeps := func(depMap map[string]string, targetLock map[string]pkg.LockedDependency) {
-		for dep, ver := range depMap {
-			wg.Add(1)
-			jobs <- installJob{
-				name:    dep,
-				version: ver,
-				lockMap: targetLock,
-			}
+	printPeerConflicts(graph)
+	printUnmetDependencies(graph)
+	fmt.Println("Installing dependencies...")
+	if err != nil {
+		// Offline, the packages that were resolved are still fetched so
+		// that every missing package is reported at once
+		errs := []error{err}
+		if err := pkg.Fetch(ctx, reg, graph, numWorkers); err != nil {
+			errs = append(errs, err)
 		}
+		printInstallErrors(errs)
+		return
+	}
+	err = pkg.Install(ctx, reg, graph, numWorkers)
+	printOptionalFailures(graph)
+	if err != nil {
+		printInstallErrors([]error{err})
+		return
+	}
+
+	lockfile, devLock := graph.Lock()
+	fmt.Println("\nAll dependencies installed successfully!")
+	pkg.SavePackageLock("package-lock.json", &pkg.PackageLock{
+		Name:     pkgJSON.Name,
+		Version:  pkgJSON.Version,
+		Lockfile: lockfile,
+		DevLock:  devLock,
+	})
+	registerProject()
+}
+
+// interruptContext returns a context cancelled by Ctrl-C, which stops an
+// install between requests instead of killing it halfway through a write.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// printPeerConflicts warns about the peer dependencies left unsatisfied.
+func printPeerConflicts(graph *pkg.Graph) {
+	if len(graph.PeerConflicts) == 0 {
+		return
+	}
+	fmt.Println("\nWarning: conflicting peer dependencies:")
+	for _, c := range graph.PeerConflicts {
+		fmt.Println("-", c)
 	}
+	fmt.Println("Use --strict-peer-deps to fail instead, or --legacy-peer-deps to ignore peer dependencies.")
+	fmt.Println()
+}
 
-	fmt.Println("Resolving and installing dependencies...")
-	queueDeps(pkgJSON.Dependencies, lock.Lockfile)
-	queueDeps(pkgJSON.DevDependencies, lock.DevLock)
+// printUnmetDependencies warns about the dependencies dependency cycles
+// left loading a version they do not accept.
+func printUnmetDependencies(graph *pkg.Graph) {
+	if len(graph.UnmetDependencies) == 0 {
+		return
+	}
+	fmt.Println("\nWarning: dependency cycles through conflicting versions leave these dependencies unmet:")
+	for _, d := range graph.UnmetDependencies {
+		fmt.Println("-", d)
+	}
+	fmt.Println()
+}
 
-	// Cleanup
-	go func() {
-		wg.Wait()
-		close(jobs)
-		close(errs)
-	}()
+// printOptionalFailures warns about the optional dependencies skipped
+// because they failed.
+func printOptionalFailures(graph *pkg.Graph) {
+	if len(graph.OptionalFailures) == 0 {
+		return
+	}
+	fmt.Println("\nWarning: skipped optional dependencies that failed:")
+	for _, err := range graph.OptionalFailures {
+		fmt.Println("-", err)
+	}
+}
 
-	// Wait for everything to finish
-	wg.Wait()
+// printInstallErrors reports failed installs. Packages missing from the
+// caches in offline mode are merged into a single list.
+func printInstallErrors(errs []error) {
+	var missing []string
+	var others []error
+	for _, err := range errs {
+		var offlineErr *pkg.OfflineError
+		if errors.As(err, &offlineErr) {
+			missing = append(missing, offlineErr.Missing...)
+		} else {
+			others = append(others, err)
+		}
+	}
 
-	if len(errs) > 0 {
+	if len(others) > 0 {
 		fmt.Println("\nErrors occurred during installation:")
-		for e := range errs {
-			fmt.Println("-", e)
+		for _, err := range others {
+			fmt.Println("-", err)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		missing = slices.Compact(missing)
+		fmt.Println("\nThe following packages are not available offline:")
+		for _, m := range missing {
+			fmt.Println("-", m)
 		}
-	} else {
-		fmt.Println("\nAll dependencies installed successfully!")
-		pkg.SavePackageLock("package-lock.json", lock)
 	}
 }
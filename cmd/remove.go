@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/sojebsikder/go-npm/pkg"
 )
@@ -23,7 +24,14 @@ func RunRemove(args []string) {
 	lock, _ := pkg.LoadPackageLock("package-lock.json")
 
 	changed := false
-	for _, name := range args {
+	for _, arg := range args {
+		spec, err := pkg.ParsePackageSpec(arg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		name := spec.Name
+
 		if _, ok := pkgJSON.Dependencies[name]; ok {
 			delete(pkgJSON.Dependencies, name)
 			changed = true
@@ -33,8 +41,14 @@ func RunRemove(args []string) {
 			changed = true
 		}
 		if lock != nil {
-			delete(lock.Lockfile, name)
-			delete(lock.DevLock, name)
+			// Packages nested below it go along with it
+			for _, deps := range []map[string]pkg.LockedDependency{lock.Lockfile, lock.DevLock} {
+				for path := range deps {
+					if path == name || strings.HasPrefix(path, name+"/node_modules/") {
+						delete(deps, path)
+					}
+				}
+			}
 		}
 		modPath := filepath.Join("node_modules", name)
 		if err := os.RemoveAll(modPath); err != nil {
@@ -42,6 +56,10 @@ func RunRemove(args []string) {
 		} else {
 			fmt.Printf("Removed %s\n", name)
 		}
+		if strings.HasPrefix(name, "@") {
+			// Drop the scope directory once its last package is gone
+			os.Remove(filepath.Dir(modPath))
+		}
 	}
 
 	if changed {
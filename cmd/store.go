@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func RunStore(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: go-npm store <path|status|prune>")
+		return
+	}
+
+	store := pkg.DefaultStore()
+	switch args[0] {
+	case "path":
+		fmt.Println(store.Dir)
+	case "status":
+		status, err := store.Status()
+		if err != nil {
+			fmt.Println("Error reading store:", err)
+			return
+		}
+		fmt.Printf("Store: %s\n", store.Dir)
+		fmt.Printf("Packages: %d (%.1f MB)\n", status.Packages, float64(status.Bytes)/(1<<20))
+		fmt.Printf("Projects: %d\n", len(status.Projects))
+		for _, project := range status.Projects {
+			fmt.Println("-", project)
+		}
+	case "prune":
+		removed, err := store.Prune()
+		if err != nil {
+			fmt.Println("Error pruning store:", err)
+			return
+		}
+		fmt.Printf("Removed %d unreferenced packages\n", removed)
+	default:
+		fmt.Printf("Unknown store command: %s\n", args[0])
+	}
+}
+
+// registerProject records the current directory with the package store so
+// that "store prune" keeps the packages it uses.
+func registerProject() {
+	if err := pkg.DefaultStore().RegisterProject("."); err != nil {
+		fmt.Println("Warning: could not register project with the store:", err)
+	}
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func RunView(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: go-npm view <package[@version]> [field]")
+		return
+	}
+
+	spec, err := pkg.ParsePackageSpec(args[0])
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if spec.Subspec != nil {
+		spec = spec.Subspec
+	}
+
+	// view shows fields the abbreviated install metadata leaves out
+	ctx, stop := interruptContext()
+	defer stop()
+	meta, err := pkg.NewRegistry().FullPackument(ctx, spec.Name)
+	if err != nil {
+		fmt.Printf("Error fetching %s: %v\n", spec.Name, err)
+		return
+	}
+	version, err := pkg.ResolveVersion(&meta.Packument, spec.FetchSpec)
+	if err != nil {
+		fmt.Printf("Error resolving %s: %v\n", spec, err)
+		return
+	}
+
+	versions, _ := meta.Document["versions"].(map[string]interface{})
+	manifest, _ := versions[version].(map[string]interface{})
+
+	if len(args) > 1 {
+		field := args[1]
+		value, ok := manifest[field]
+		if !ok {
+			value, ok = meta.Document[field]
+		}
+		if !ok {
+			return
+		}
+		out, _ := json.MarshalIndent(value, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	verMeta, err := meta.Manifest(version)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	license, _ := manifest["license"].(string)
+	description, _ := manifest["description"].(string)
+
+	fmt.Printf("%s@%s | %s | deps: %d\n", meta.Name, version, license, len(verMeta.Dependencies))
+	if description != "" {
+		fmt.Println(description)
+	}
+	fmt.Println()
+
+	tags := make([]string, 0, len(meta.DistTags))
+	for tag := range meta.DistTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	fmt.Println("dist-tags:")
+	for _, tag := range tags {
+		fmt.Printf("  %s: %s\n", tag, meta.DistTags[tag])
+	}
+	if published, ok := meta.Time[version].(string); ok {
+		fmt.Println("published:", published)
+	}
+	fmt.Println("tarball:", verMeta.Dist.Tarball)
+	if verMeta.Dist.Integrity != "" {
+		fmt.Println("integrity:", verMeta.Dist.Integrity)
+	}
+}
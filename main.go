@@ -20,7 +20,20 @@ func printUsage() {
 	fmt.Printf("%s add [--dev] <package[@version]> [...]\n", appName)
 	fmt.Printf("%s remove <package> [...] \n", appName)
 	fmt.Printf("%s ci\n", appName)
-	fmt.Printf("%s run <script>", appName)
+	fmt.Printf("%s run <script>\n", appName)
+	fmt.Printf("%s store <path|status|prune>\n", appName)
+	fmt.Printf("%s view <package[@version]> [field]\n", appName)
+	fmt.Println()
+	fmt.Println("Options for all commands:")
+	fmt.Println("  --registry <url>    Registry to use instead of the one from .npmrc")
+	fmt.Println("  --prefer-online     Revalidate cached metadata (default)")
+	fmt.Println("  --prefer-offline    Use cached metadata without revalidating")
+	fmt.Println("  --offline           Never access the network")
+	fmt.Println("  --legacy-peer-deps  Ignore peerDependencies")
+	fmt.Println("  --strict-peer-deps  Fail on conflicting peerDependencies instead of warning")
+	fmt.Println("  --os <os>           Install optionalDependencies for another os, like linux or darwin")
+	fmt.Println("  --cpu <cpu>         Install optionalDependencies for another cpu, like x64 or arm64")
+	fmt.Println("  --libc <libc>       Install optionalDependencies for another libc, glibc or musl")
 }
 
 func main() {
@@ -30,6 +43,12 @@ func main() {
 	}
 
 	cmdName := os.Args[1]
+	args, err := cmd.LoadConfig(cmdName, os.Args[2:])
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return
+	}
+
 	switch cmdName {
 	case "version":
 		fmt.Printf("%s v%s\n", appName, version)
@@ -38,20 +57,24 @@ func main() {
 	case "install":
 		fs := flag.NewFlagSet("install", flag.ExitOnError)
 		pkgPath := fs.String("package", "package.json", "Path to package.json")
-		fs.Parse(os.Args[2:])
+		fs.Parse(args)
 		cmd.RunInstall(*pkgPath)
 	case "init":
 		cmd.RunInit()
 	case "add":
-		cmd.RunAdd(os.Args[2:])
+		cmd.RunAdd(args)
 	case "remove":
-		cmd.RunRemove(os.Args[2:])
+		cmd.RunRemove(args)
 	case "ci":
 		cmd.RunCI()
 	case "run":
-		cmd.RunScript(os.Args[2:])
+		cmd.RunScript(args)
+	case "store":
+		cmd.RunStore(args)
+	case "view":
+		cmd.RunView(args)
 	default:
 		fmt.Printf("Unknown command: %s\n", cmdName)
-		fmt.Println("Available commands: install, init, add, remove, ci, run")
+		fmt.Println("Available commands: install, init, add, remove, ci, run, store, view")
 	}
 }
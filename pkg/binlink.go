@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 func CreateBinLinks(pkgDir string) error {
@@ -28,7 +29,8 @@ func CreateBinLinks(pkgDir string) error {
 	switch binVal := binField.(type) {
 	case string:
 		if name, ok := pkgMeta["name"].(string); ok {
-			binMap[name] = binVal
+			// A scoped package's bin is named without the scope, like in npm
+			binMap[name[strings.LastIndex(name, "/")+1:]] = binVal
 		}
 	case map[string]interface{}:
 		for k, v := range binVal {
@@ -40,17 +42,36 @@ func CreateBinLinks(pkgDir string) error {
 		return nil
 	}
 
-	binDir := filepath.Join("node_modules", ".bin")
+	// Bins go to the .bin of the node_modules holding the package, so
+	// nested packages don't replace the bins of top-level ones
+	nodeModules := filepath.Dir(pkgDir)
+	if strings.HasPrefix(filepath.Base(nodeModules), "@") {
+		nodeModules = filepath.Dir(nodeModules)
+	}
+	binDir := filepath.Join(nodeModules, ".bin")
 	if err := os.MkdirAll(binDir, 0755); err != nil {
 		return err
 	}
 
 	for binName, binRelPath := range binMap {
+		// Names and targets come from the package, so neither may reach out
+		// of .bin or the package: the target is chmodded, and installed
+		// files are shared with every project through the store
+		if !validBinName(binName) {
+			continue
+		}
 		fullBinPath := filepath.Join(pkgDir, binRelPath)
+		if rel, err := filepath.Rel(pkgDir, fullBinPath); err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
 		binLink := filepath.Join(binDir, binName)
 
-		// ensure the subdirectory for the binary exists
-		if err := os.MkdirAll(filepath.Dir(binLink), 0755); err != nil {
+		info, err := os.Stat(fullBinPath)
+		if os.IsNotExist(err) {
+			// npm ignores bins that the package does not actually ship
+			continue
+		}
+		if err != nil {
 			return err
 		}
 
@@ -117,12 +138,21 @@ exit $LASTEXITCODE
 			if err := os.Symlink(relTarget, binLink); err != nil {
 				return err
 			}
-			// Ensure executable permission
-			if err := os.Chmod(fullBinPath, 0755); err != nil {
-				// non-critical, fallback silently
+			// Extraction keeps the tarball modes, only bins packed without an
+			// executable bit need fixing up
+			if info.Mode()&0111 == 0 {
+				if err := os.Chmod(fullBinPath, info.Mode()|0111); err != nil {
+					return err
+				}
 			}
 		}
 	}
 
 	return nil
 }
+
+// validBinName reports whether name can be linked as a file of its own in
+// .bin.
+func validBinName(name string) bool {
+	return name != "" && name != "." && !strings.Contains(name, "..") && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,71 @@
+package pkg_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func TestCreateBinLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("bins are .cmd shims on Windows")
+	}
+	t.Chdir(t.TempDir())
+
+	pkgDir := filepath.Join("node_modules", "tool")
+	os.MkdirAll(filepath.Join(pkgDir, "bin"), 0755)
+	os.WriteFile(filepath.Join(pkgDir, "package.json"), []byte(`{"name":"tool","bin":{"tool":"bin/tool.js","ghost":"bin/missing.js"}}`), 0644)
+	os.WriteFile(filepath.Join(pkgDir, "bin", "tool.js"), []byte("#!/usr/bin/env node\n"), 0644)
+
+	if err := pkg.CreateBinLinks(pkgDir); err != nil {
+		t.Fatalf("Failed to create bin links: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join("node_modules", ".bin", "tool"))
+	if err != nil {
+		t.Fatalf("Bin link not created: %v", err)
+	}
+	if info.Mode()&0111 == 0 {
+		t.Errorf("Bin target is not executable: %v", info.Mode())
+	}
+	if _, err := os.Lstat(filepath.Join("node_modules", ".bin", "ghost")); !os.IsNotExist(err) {
+		t.Errorf("Link created for a bin the package does not ship")
+	}
+}
+
+func TestCreateBinLinksStaysInPackage(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("bins are .cmd shims on Windows")
+	}
+	t.Chdir(t.TempDir())
+
+	pkgDir := filepath.Join("node_modules", "evil")
+	os.MkdirAll(pkgDir, 0755)
+	os.WriteFile(filepath.Join(pkgDir, "package.json"), []byte(`{"name":"evil","bin":{
+		"outside":"../other/run.js",
+		"../escape":"index.js",
+		"sub/dir":"index.js"}}`), 0644)
+	os.WriteFile(filepath.Join(pkgDir, "index.js"), []byte("#!/usr/bin/env node\n"), 0644)
+	os.MkdirAll(filepath.Join("node_modules", "other"), 0755)
+	os.WriteFile(filepath.Join("node_modules", "other", "run.js"), []byte("shared"), 0644)
+
+	if err := pkg.CreateBinLinks(pkgDir); err != nil {
+		t.Fatalf("Failed to create bin links: %v", err)
+	}
+
+	if info, _ := os.Stat(filepath.Join("node_modules", "other", "run.js")); info.Mode()&0111 != 0 {
+		t.Errorf("A file outside the package was made executable: %v", info.Mode())
+	}
+	for _, path := range []string{
+		filepath.Join("node_modules", ".bin", "outside"),
+		filepath.Join("node_modules", "escape"),
+		filepath.Join("node_modules", ".bin", "sub"),
+	} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("Unexpected bin link %s", path)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	CachePreferOnline  = "prefer-online"
+	CachePreferOffline = "prefer-offline"
+	CacheOffline       = "offline"
+)
+
+// cacheEntry is a registry document stored on disk together with the
+// validators needed to revalidate it.
+type cacheEntry struct {
+	URL          string          `json:"url"`
+	Accept       string          `json:"accept"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"lastModified,omitempty"`
+	Body         json.RawMessage `json:"body"`
+}
+
+// NotCachedError is returned in offline mode for documents that were never
+// fetched before.
+type NotCachedError struct {
+	URL string
+}
+
+func (e *NotCachedError) Error() string {
+	return fmt.Sprintf("%s is not in the cache and the network is disabled (offline mode)", e.URL)
+}
+
+// OfflineError lists the packages, as name@version or name@range, that an
+// offline install needed but could not find in the caches.
+type OfflineError struct {
+	Missing []string
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("not available offline: %s", strings.Join(e.Missing, ", "))
+}
+
+// add merges the packages of an OfflineError into e. It reports whether the
+// install can carry on, which is the case when err is nil or a cache miss.
+func (e *OfflineError) add(err error) bool {
+	if err == nil {
+		return true
+	}
+	var offlineErr *OfflineError
+	if !errors.As(err, &offlineErr) {
+		return false
+	}
+	e.Missing = append(e.Missing, offlineErr.Missing...)
+	return true
+}
+
+// offlineMiss turns cache misses into an OfflineError naming the package.
+func offlineMiss(err error, name, version string) error {
+	if err == nil {
+		return nil
+	}
+	var notCached *NotCachedError
+	if errors.As(err, &notCached) {
+		return &OfflineError{Missing: []string{name + "@" + version}}
+	}
+	return err
+}
+
+var (
+	metaMemoMu sync.Mutex
+	metaMemo   = make(map[string]*Packument)
+)
+
+// ResetMetadataMemo forgets the packuments fetched earlier in this process,
+// so the next fetch goes back to the disk cache and the registry.
+func ResetMetadataMemo() {
+	metaMemoMu.Lock()
+	metaMemo = make(map[string]*Packument)
+	metaMemoMu.Unlock()
+}
+
+// CacheDir returns the configured cache directory, defaulting to
+// ~/.snpm/cache.
+func CacheDir() string {
+	if dir := Cfg.Get("cache"); dir != "" {
+		return dir
+	}
+	return filepath.Join(snpmHome(), "cache")
+}
+
+// CacheMode tells how the metadata cache is used: prefer-online always
+// revalidates, prefer-offline uses cached documents without asking the
+// registry and offline never touches the network.
+func (c *Config) CacheMode() string {
+	switch {
+	case c.Bool(CacheOffline):
+		return CacheOffline
+	case c.Bool(CachePreferOffline):
+		return CachePreferOffline
+	default:
+		return CachePreferOnline
+	}
+}
+
+// fetchCached returns the body of a registry document in the format
+// selected by accept, going through the on-disk cache according to the
+// configured cache mode.
+func fetchCached(ctx context.Context, url, accept string) ([]byte, error) {
+	mode := Cfg.CacheMode()
+	entry := loadCacheEntry(url, accept)
+
+	if entry != nil && mode != CachePreferOnline {
+		return entry.Body, nil
+	}
+	if mode == CacheOffline {
+		return nil, &NotCachedError{URL: url}
+	}
+
+	req, err := newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := do(req)
+	if err != nil {
+		if entry != nil && ctx.Err() == nil {
+			// Stale data beats no data when the registry is unreachable
+			return entry.Body, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		return entry.Body, nil
+	}
+	if retryableStatus(resp.StatusCode) && entry != nil {
+		return entry.Body, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("GET %s: invalid JSON response", url)
+	}
+
+	saveCacheEntry(&cacheEntry{
+		URL:          url,
+		Accept:       accept,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         body,
+	})
+	return body, nil
+}
+
+func cacheEntryPath(url, accept string) string {
+	sum := sha256.Sum256([]byte(accept + "\n" + url))
+	return filepath.Join(CacheDir(), "metadata", hex.EncodeToString(sum[:])+".json")
+}
+
+func loadCacheEntry(url, accept string) *cacheEntry {
+	data, err := os.ReadFile(cacheEntryPath(url, accept))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URL != url || entry.Accept != accept {
+		return nil
+	}
+	return &entry
+}
+
+// saveCacheEntry writes the entry through a temp file so concurrent readers
+// never see a partial document. Failing to cache is not fatal.
+func saveCacheEntry(entry *cacheEntry) {
+	path := cacheEntryPath(entry.URL, entry.Accept)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+tempMarker+"*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || os.Rename(tmp.Name(), path) != nil {
+		os.Remove(tmp.Name())
+	}
+}
@@ -0,0 +1,91 @@
+package pkg_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func newPackumentServer(t *testing.T, hits *int, revalidated *int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			*revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"name":"cached","dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{}}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchPackageMetaMemoizesPerRun(t *testing.T) {
+	var hits, revalidated int
+	srv := newPackumentServer(t, &hits, &revalidated)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+
+	for i := 0; i < 3; i++ {
+		if _, err := pkg.FetchPackageMeta("cached"); err != nil {
+			t.Fatalf("Failed to fetch package metadata: %v", err)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("Expected a single request, got %d", hits)
+	}
+}
+
+func TestFetchPackageMetaRevalidates(t *testing.T) {
+	var hits, revalidated int
+	srv := newPackumentServer(t, &hits, &revalidated)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+
+	if _, err := pkg.FetchPackageMeta("cached"); err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+
+	// A new run revalidates the cached document with its ETag
+	pkg.ResetMetadataMemo()
+	meta, err := pkg.FetchPackageMeta("cached")
+	if err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+	if revalidated != 1 {
+		t.Errorf("Expected a conditional request, got %d", revalidated)
+	}
+	if meta.Name != "cached" {
+		t.Errorf("304 response did not return the cached document: %v", meta)
+	}
+
+	// prefer-offline and offline use the cache without asking
+	for _, mode := range []string{pkg.CachePreferOffline, pkg.CacheOffline} {
+		pkg.ResetMetadataMemo()
+		cfg.Set(mode, "true")
+		if _, err := pkg.FetchPackageMeta("cached"); err != nil {
+			t.Fatalf("Failed to fetch package metadata in %s mode: %v", mode, err)
+		}
+		cfg.Set(mode, "")
+	}
+	if hits != 2 {
+		t.Errorf("Expected 2 requests in total, got %d", hits)
+	}
+}
+
+func TestFetchPackageMetaOfflineMiss(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.Set("registry", "http://registry.invalid/")
+	cfg.Set("offline", "true")
+
+	_, err := pkg.FetchPackageMeta("never-fetched")
+	var notCached *pkg.NotCachedError
+	if !errors.As(err, &notCached) {
+		t.Fatalf("Expected NotCachedError, got %v", err)
+	}
+}
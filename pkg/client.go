@@ -1,16 +1,216 @@
 package pkg
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+// Defaults for the fetch-* settings, the same as npm's.
+const (
+	defaultFetchRetries         = 2
+	defaultFetchRetryFactor     = 10
+	defaultFetchRetryMinTimeout = 10000
+	defaultFetchRetryMaxTimeout = 60000
+	defaultFetchTimeout         = 300000
+)
+
+// HttpClient has no overall timeout, fetch-timeout only limits how long a
+// request goes without receiving anything. Its transport is shared by all
+// requests and follows the config, see newTransport.
 var HttpClient = &http.Client{
-	Timeout: 30 * time.Second,
-	// Transport: &http.Transport{
-	// 	MaxIdleConns:        100,
-	// 	IdleConnTimeout:     90 * time.Second,
-	// 	MaxIdleConnsPerHost: 20,
-	// },
-	Transport: http.DefaultTransport,
+	Transport: configTransport{},
+}
+
+// NotFoundError is returned when the registry answers 404, for a package
+// that does not exist or a tarball that is gone.
+type NotFoundError struct {
+	Name string
+	URL  string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("package %s not found in the registry (%s)", e.Name, redactURL(e.URL))
+	}
+	return fmt.Sprintf("%s not found", redactURL(e.URL))
+}
+
+// HTTPError is an unexpected response status that retrying did not fix.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("GET %s: %s", redactURL(e.URL), e.Status)
+}
+
+// statusError turns a non-200 response into a NotFoundError or HTTPError.
+func statusError(resp *http.Response) error {
+	url := resp.Request.URL.String()
+	if resp.StatusCode == http.StatusNotFound {
+		return &NotFoundError{URL: url}
+	}
+	return &HTTPError{URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// retryPolicy is read from the fetch-retries, fetch-retry-factor,
+// fetch-retry-mintimeout, fetch-retry-maxtimeout and fetch-timeout settings,
+// times being in milliseconds.
+type retryPolicy struct {
+	retries    int
+	factor     float64
+	minTimeout time.Duration
+	maxTimeout time.Duration
+	timeout    time.Duration
+}
+
+func (c *Config) retryPolicy() retryPolicy {
+	ms := func(key string, def int64) time.Duration {
+		return time.Duration(c.Int(key, def)) * time.Millisecond
+	}
+	return retryPolicy{
+		retries:    int(c.Int("fetch-retries", defaultFetchRetries)),
+		factor:     float64(c.Int("fetch-retry-factor", defaultFetchRetryFactor)),
+		minTimeout: ms("fetch-retry-mintimeout", defaultFetchRetryMinTimeout),
+		maxTimeout: ms("fetch-retry-maxtimeout", defaultFetchRetryMaxTimeout),
+		timeout:    ms("fetch-timeout", defaultFetchTimeout),
+	}
+}
+
+// backoff is how long to wait before retry number attempt+1.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	wait := float64(p.minTimeout) * math.Pow(p.factor, float64(attempt))
+	if wait > float64(p.maxTimeout) {
+		return p.maxTimeout
+	}
+	return time.Duration(wait)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// newRequest builds a GET request carrying the credentials configured for
+// the request's host, if any.
+func newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth := Cfg.AuthHeader(url); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req, nil
+}
+
+// do sends req, retrying network errors, 429 and 5xx responses with
+// exponential backoff. A Retry-After header replaces the computed delay,
+// capped at fetch-retry-maxtimeout. The last response is returned whatever
+// its status, so callers still decide what a status means. Cancelling the
+// request's context also stops the retries.
+//
+// The request fails after fetch-timeout without receiving anything, while
+// waiting for the headers or, once it is returned, reading the body.
+func do(req *http.Request) (*http.Response, error) {
+	// Settings errors such as an unreadable cafile are not worth retrying
+	if _, err := Cfg.transport(); err != nil {
+		return nil, err
+	}
+	policy := Cfg.retryPolicy()
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithCancelCause(req.Context())
+		idle := time.AfterFunc(policy.timeout, func() {
+			cancel(fmt.Errorf("GET %s: nothing received for %v: %w", redactURL(req.URL.String()), policy.timeout, context.DeadlineExceeded))
+		})
+		stop := func() {
+			idle.Stop()
+			cancel(nil)
+		}
+		resp, err := HttpClient.Do(req.Clone(ctx))
+		if err != nil && req.Context().Err() == nil && context.Cause(ctx) != nil {
+			err = context.Cause(ctx)
+		}
+		if attempt >= policy.retries || (err == nil && !retryableStatus(resp.StatusCode)) {
+			if err != nil {
+				stop()
+				return nil, err
+			}
+			resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, ctx: ctx, idle: idle, timeout: policy.timeout, stop: stop}
+			return resp, nil
+		}
+
+		wait := policy.backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = min(after, policy.maxTimeout)
+			}
+			resp.Body.Close()
+		}
+		stop()
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// idleTimeoutBody restarts the request's idle timeout whenever data comes
+// in, and keeps its context alive until the body is closed.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	idle    *time.Timer
+	timeout time.Duration
+	stop    func()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.idle.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF {
+		// Report the idle timeout rather than a bare cancellation
+		if cause := context.Cause(b.ctx); cause != nil && !errors.Is(cause, context.Canceled) {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	return err
+}
+
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return do(req)
 }
@@ -0,0 +1,171 @@
+package pkg_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestRetriesServerErrors(t *testing.T) {
+	reg := registrytest.New(t, registrytest.Package{Name: "flaky", Version: "1.0.0"})
+	reg.FailNext("/flaky", http.StatusServiceUnavailable, http.StatusBadGateway)
+	reg.FailNext(registrytest.TarballPath("flaky", "1.0.0"), http.StatusInternalServerError)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	lock := make(map[string]pkg.LockedDependency)
+	if err := pkg.InstallPackage(t.Context(), pkg.NewRegistry(), "flaky", "1.0.0", lock); err != nil {
+		t.Fatalf("Expected retries to recover, got %v", err)
+	}
+	if n := reg.Requests("/flaky"); n != 3 {
+		t.Errorf("Expected 3 metadata requests, got %d", n)
+	}
+	if n := reg.Requests(registrytest.TarballPath("flaky", "1.0.0")); n != 2 {
+		t.Errorf("Expected 2 tarball requests, got %d", n)
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	reg := registrytest.New(t, registrytest.Package{Name: "down", Version: "1.0.0"})
+	reg.FailNext("/down", 500, 500, 500, 500)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	cfg.Set("fetch-retries", "1")
+
+	_, err := pkg.NewRegistry().Packument(t.Context(), "down")
+	var httpErr *pkg.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != 500 {
+		t.Fatalf("Expected HTTPError 500, got %v", err)
+	}
+	if n := reg.Requests("/down"); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+}
+
+func TestNotFoundIsNotRetried(t *testing.T) {
+	reg := registrytest.New(t, registrytest.Package{Name: "exists", Version: "1.0.0"})
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+
+	_, err := pkg.NewRegistry().Packument(t.Context(), "missing")
+	var notFound *pkg.NotFoundError
+	if !errors.As(err, &notFound) || notFound.Name != "missing" {
+		t.Fatalf("Expected NotFoundError for missing, got %v", err)
+	}
+	if n := reg.Requests("/missing"); n != 1 {
+		t.Errorf("Expected a single request, got %d", n)
+	}
+
+	err = pkg.DownloadAndExtractTarball(reg.TarballURL("exists", "9.9.9"), filepath.Join(t.TempDir(), "pkg"), "")
+	if !errors.As(err, &notFound) {
+		t.Errorf("Expected NotFoundError for tarball, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"name":"limited","versions":{"1.0.0":{}}}`))
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("fetch-retry-maxtimeout", "5000")
+
+	start := time.Now()
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "limited"); err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retry-After was not honored, retried after %v", elapsed)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("fetch-timeout", "50")
+	cfg.Set("fetch-retries", "0")
+
+	start := time.Now()
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "slow"); err == nil {
+		t.Fatalf("Expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("fetch-timeout not applied, took %v", elapsed)
+	}
+}
+
+func TestRetriesInterruptedDownload(t *testing.T) {
+	tarball := registrytest.Tarball(map[string]string{"index.js": "module.exports = 1"})
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits == 1 {
+			// Promise the whole tarball, then drop the connection halfway
+			w.Header().Set("Content-Length", strconv.Itoa(len(tarball)))
+			w.Write(tarball[:len(tarball)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+	useTestConfig(t)
+
+	dest := filepath.Join(t.TempDir(), "pkg")
+	if err := pkg.DownloadAndExtractTarball(srv.URL, dest, registrytest.Integrity(tarball)); err != nil {
+		t.Fatalf("Expected the download to be retried, got %v", err)
+	}
+	if hits != 2 {
+		t.Errorf("Expected 2 tarball requests, got %d", hits)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "index.js")); string(content) != "module.exports = 1" {
+		t.Errorf("Package was not extracted: %q", content)
+	}
+}
+
+func TestFetchTimeoutAppliesToIdleTime(t *testing.T) {
+	body := []byte(`{"name":"trickle","versions":{"1.0.0":{}}}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Takes well over fetch-timeout in total, but never pauses that long
+		for _, b := range body {
+			w.Write([]byte{b})
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("fetch-timeout", "200")
+	cfg.Set("fetch-retries", "0")
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "trickle"); err != nil {
+		t.Fatalf("Expected a slow but steady response to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const DefaultRegistry = "https://registry.npmjs.org/"
+
+// Config holds npm-style settings merged from .npmrc files, the environment
+// and command line flags.
+type Config struct {
+	values map[string]string
+}
+
+// Cfg is the configuration used by the fetch layer.
+var Cfg = NewConfig()
+
+var envRef = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+func NewConfig() *Config {
+	return &Config{values: map[string]string{
+		"registry": DefaultRegistry,
+	}}
+}
+
+// LoadConfig reads the global, user and project .npmrc files in that order,
+// then applies SNPM_REGISTRY and finally the given overrides, so later sources
+// win over earlier ones.
+func LoadConfig(overrides map[string]string) (*Config, error) {
+	c := NewConfig()
+	for _, path := range []string{globalConfigPath(), userConfigPath(), ".npmrc"} {
+		if path == "" {
+			continue
+		}
+		if err := c.LoadFile(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if registry := os.Getenv("SNPM_REGISTRY"); registry != "" {
+		c.Set("registry", registry)
+	}
+	for key, value := range overrides {
+		c.Set(key, value)
+	}
+	return c, nil
+}
+
+// LoadFile merges the key=value pairs of an .npmrc file into the config.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = expandEnv(strings.TrimSpace(key))
+		value = expandEnv(unquote(strings.TrimSpace(value)))
+		c.Set(key, value)
+	}
+	return scanner.Err()
+}
+
+func (c *Config) Get(key string) string {
+	return c.values[key]
+}
+
+func (c *Config) Set(key, value string) {
+	c.values[key] = value
+}
+
+// Bool reports whether key is set to a true value such as "true" or "1".
+func (c *Config) Bool(key string) bool {
+	b, _ := strconv.ParseBool(c.Get(key))
+	return b
+}
+
+// Int returns key as an integer, or def when it is unset or malformed.
+func (c *Config) Int(key string, def int64) int64 {
+	n, err := strconv.ParseInt(c.Get(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// Registry returns the configured registry URL, always ending in a slash.
+func (c *Config) Registry() string {
+	return withTrailingSlash(c.Get("registry"))
+}
+
+// RegistryFor returns the registry serving a package, honouring
+// "@scope:registry" mappings for scoped names.
+func (c *Config) RegistryFor(name string) string {
+	if scope, _, ok := strings.Cut(name, "/"); ok && strings.HasPrefix(scope, "@") {
+		if registry := c.Get(scope + ":registry"); registry != "" {
+			return withTrailingSlash(registry)
+		}
+	}
+	return c.Registry()
+}
+
+// ReplaceRegistryHost points tarball URLs served by the public registry at
+// the registry configured for the package, the same way npm does for mirrors.
+func (c *Config) ReplaceRegistryHost(name, tarballURL string) string {
+	registry := c.RegistryFor(name)
+	if registry == DefaultRegistry || !strings.HasPrefix(tarballURL, DefaultRegistry) {
+		return tarballURL
+	}
+	return registry + strings.TrimPrefix(tarballURL, DefaultRegistry)
+}
+
+// AuthHeader returns the Authorization header value for a request to rawURL,
+// or "" when no credentials are configured for it. Credentials are looked up
+// by "//host/path/:" prefixes so they are only ever sent to their own host.
+func (c *Config) AuthHeader(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		path = path[:i+1]
+	}
+	for {
+		prefix := "//" + u.Host + path + ":"
+		if token := c.Get(prefix + "_authToken"); token != "" {
+			return "Bearer " + token
+		}
+		if auth := c.Get(prefix + "_auth"); auth != "" {
+			return "Basic " + auth
+		}
+		if username := c.Get(prefix + "username"); username != "" {
+			password, err := base64.StdEncoding.DecodeString(c.Get(prefix + "_password"))
+			if err == nil {
+				return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+string(password)))
+			}
+		}
+
+		if path == "/" || path == "" {
+			return ""
+		}
+		path = path[:strings.LastIndex(strings.TrimSuffix(path, "/"), "/")+1]
+	}
+}
+
+func globalConfigPath() string {
+	if path := os.Getenv("SNPM_GLOBALCONFIG"); path != "" {
+		return path
+	}
+	if runtime.GOOS == "windows" {
+		appData := os.Getenv("APPDATA")
+		if appData == "" {
+			return ""
+		}
+		return filepath.Join(appData, "npm", "etc", "npmrc")
+	}
+	return filepath.Join("/usr/local", "etc", "npmrc")
+}
+
+func userConfigPath() string {
+	if path := os.Getenv("SNPM_USERCONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".npmrc")
+}
+
+func withTrailingSlash(s string) string {
+	if strings.HasSuffix(s, "/") {
+		return s
+	}
+	return s + "/"
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// expandEnv replaces ${VAR} references with environment values. Bare $VAR is
+// left alone so that passwords containing "$" survive.
+func expandEnv(s string) string {
+	return envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
@@ -0,0 +1,126 @@
+package pkg_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tempDir := t.TempDir()
+	t.Chdir(tempDir)
+
+	globalRC := filepath.Join(tempDir, "global-npmrc")
+	userRC := filepath.Join(tempDir, "user-npmrc")
+	os.WriteFile(globalRC, []byte("registry=https://global.example/\nfoo=global\nbar=global\n"), 0644)
+	os.WriteFile(userRC, []byte("# comment\nregistry = \"https://user.example/\"\nfoo=user\n"), 0644)
+	os.WriteFile(".npmrc", []byte("; comment\nregistry=https://project.example\n"), 0644)
+	t.Setenv("SNPM_GLOBALCONFIG", globalRC)
+	t.Setenv("SNPM_USERCONFIG", userRC)
+	t.Setenv("SNPM_REGISTRY", "")
+
+	cfg, err := pkg.LoadConfig(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if got := cfg.Registry(); got != "https://project.example/" {
+		t.Errorf("Expected project registry, got %s", got)
+	}
+	if cfg.Get("foo") != "user" || cfg.Get("bar") != "global" {
+		t.Errorf("Unexpected merged values: foo=%s bar=%s", cfg.Get("foo"), cfg.Get("bar"))
+	}
+
+	t.Setenv("SNPM_REGISTRY", "https://env.example/")
+	cfg, _ = pkg.LoadConfig(nil)
+	if got := cfg.Registry(); got != "https://env.example/" {
+		t.Errorf("Expected env registry, got %s", got)
+	}
+
+	cfg, _ = pkg.LoadConfig(map[string]string{"registry": "https://flag.example"})
+	if got := cfg.Registry(); got != "https://flag.example/" {
+		t.Errorf("Expected flag registry, got %s", got)
+	}
+}
+
+func TestReplaceRegistryHost(t *testing.T) {
+	cfg := pkg.NewConfig()
+	tarball := "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz"
+	if got := cfg.ReplaceRegistryHost("lodash", tarball); got != tarball {
+		t.Errorf("Default registry should not rewrite URLs, got %s", got)
+	}
+
+	cfg.Set("registry", "http://mirror.local/npm")
+	want := "http://mirror.local/npm/lodash/-/lodash-4.17.21.tgz"
+	if got := cfg.ReplaceRegistryHost("lodash", tarball); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	other := "https://cdn.example/lodash.tgz"
+	if got := cfg.ReplaceRegistryHost("lodash", other); got != other {
+		t.Errorf("Foreign tarball URLs should be left alone, got %s", got)
+	}
+}
+
+func TestScopedRegistryAndAuth(t *testing.T) {
+	tempDir := t.TempDir()
+	rc := filepath.Join(tempDir, "npmrc")
+	os.WriteFile(rc, []byte(`registry=https://registry.example/
+@ourco:registry=https://npm.ourco.example/private
+//npm.ourco.example/private/:_authToken=${OURCO_TOKEN}
+//basic.example/:_auth=dXNlcjpwYXNz
+//legacy.example/:username=bob
+//legacy.example/:_password=c2VjcmV0
+`), 0644)
+	t.Setenv("OURCO_TOKEN", "s3cret")
+
+	cfg := pkg.NewConfig()
+	if err := cfg.LoadFile(rc); err != nil {
+		t.Fatalf("Failed to load npmrc: %v", err)
+	}
+
+	if got := cfg.RegistryFor("@ourco/widgets"); got != "https://npm.ourco.example/private/" {
+		t.Errorf("Unexpected scoped registry: %s", got)
+	}
+	if got := cfg.RegistryFor("@other/widgets"); got != "https://registry.example/" {
+		t.Errorf("Unmapped scope should use default registry, got %s", got)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://npm.ourco.example/private/@ourco%2fwidgets", "Bearer s3cret"},
+		{"https://npm.ourco.example/private/@ourco/widgets/-/widgets-1.0.0.tgz", "Bearer s3cret"},
+		{"https://npm.ourco.example/public/widgets", ""},
+		{"https://registry.example/lodash", ""},
+		{"https://evil.example/private/@ourco%2fwidgets", ""},
+		{"https://basic.example/pkg", "Basic dXNlcjpwYXNz"},
+		{"https://legacy.example/pkg", "Basic Ym9iOnNlY3JldA=="},
+	}
+	for _, tt := range tests {
+		if got := cfg.AuthHeader(tt.url); got != tt.want {
+			t.Errorf("AuthHeader(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+// useTestConfig installs a fresh config whose cache and store live in
+// temporary directories and whose retries are quick, and restores the
+// default when the test ends.
+func useTestConfig(t testing.TB) *pkg.Config {
+	t.Helper()
+	cfg := pkg.NewConfig()
+	cfg.Set("cache", filepath.Join(t.TempDir(), "cache"))
+	cfg.Set("store-dir", filepath.Join(t.TempDir(), "store"))
+	cfg.Set("fetch-retry-mintimeout", "1")
+	cfg.Set("fetch-retry-maxtimeout", "10")
+	pkg.Cfg = cfg
+	pkg.ResetMetadataMemo()
+	t.Cleanup(func() {
+		pkg.Cfg = pkg.NewConfig()
+		pkg.ResetMetadataMemo()
+	})
+	return cfg
+}
@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultMaxTarballSize  = 1 << 30
+	defaultMaxTarballFiles = 100000
+)
+
+// extractTarball unpacks a gzipped package tarball into dest, dropping the
+// leading "package/" directory. Entries that would land outside dest, links
+// pointing outside it, and archives over the configured tarball-max-size or
+// tarball-max-files limits are rejected.
+func extractTarball(r io.Reader, dest string) error {
+	maxSize := Cfg.Int("tarball-max-size", defaultMaxTarballSize)
+	maxFiles := Cfg.Int("tarball-max-files", defaultMaxTarballFiles)
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+
+	var size, files int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		files++
+		if files > maxFiles {
+			return fmt.Errorf("tarball has more than %d entries", maxFiles)
+		}
+
+		relPath, err := tarEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if relPath == "" {
+			continue
+		}
+		target := filepath.Join(dest, relPath)
+		if err := checkNoSymlinkParents(dest, relPath); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mode := dirMode(hdr.Mode)
+			if err := os.MkdirAll(target, mode); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			size += hdr.Size
+			if size > maxSize {
+				return fmt.Errorf("tarball expands to more than %d bytes", maxSize)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// Never write through a link left by an earlier entry
+			os.Remove(target)
+			if err := writeFile(target, tr, fileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := extractSymlink(dest, relPath, hdr.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if err := extractHardlink(dest, relPath, hdr.Linkname); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarEntryPath strips the top-level directory from an entry name and returns
+// a clean relative path, or an error if the entry tries to escape.
+func tarEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", fmt.Errorf("unsafe absolute path in tarball: %s", name)
+	}
+
+	_, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return "", nil
+	}
+	cleaned := path.Clean(rest)
+	if cleaned == "." {
+		return "", nil
+	}
+	relPath := filepath.FromSlash(cleaned)
+	if !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("unsafe path in tarball: %s", name)
+	}
+	return relPath, nil
+}
+
+// checkNoSymlinkParents makes sure no directory between dest and relPath is
+// a symlink, so entries can never be written through a link.
+func checkNoSymlinkParents(dest, relPath string) error {
+	current := dest
+	parts := strings.Split(filepath.Dir(relPath), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("unsafe tarball entry %s: parent is a symlink", filepath.ToSlash(relPath))
+		}
+	}
+	return nil
+}
+
+func extractSymlink(dest, relPath, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return fmt.Errorf("unsafe symlink in tarball: %s -> %s", filepath.ToSlash(relPath), linkname)
+	}
+	resolved := filepath.Join(filepath.Dir(relPath), filepath.FromSlash(linkname))
+	if !filepath.IsLocal(resolved) {
+		return fmt.Errorf("unsafe symlink in tarball: %s -> %s", filepath.ToSlash(relPath), linkname)
+	}
+
+	target := filepath.Join(dest, relPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	os.Remove(target)
+	return os.Symlink(linkname, target)
+}
+
+// extractHardlink links to a file extracted earlier from the same tarball,
+// copying it when the filesystem does not support hard links.
+func extractHardlink(dest, relPath, linkname string) error {
+	sourceRel, err := tarEntryPath(linkname)
+	if err != nil || sourceRel == "" {
+		return fmt.Errorf("unsafe hard link in tarball: %s -> %s", filepath.ToSlash(relPath), linkname)
+	}
+	if err := checkNoSymlinkParents(dest, sourceRel); err != nil {
+		return err
+	}
+
+	source := filepath.Join(dest, sourceRel)
+	info, err := os.Lstat(source)
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("hard link %s points to missing file %s", filepath.ToSlash(relPath), linkname)
+	}
+
+	target := filepath.Join(dest, relPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	os.Remove(target)
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFile(target, in, info.Mode().Perm())
+}
+
+func writeFile(target string, r io.Reader, mode os.FileMode) error {
+	outFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(outFile, r); err != nil {
+		outFile.Close()
+		return err
+	}
+	return outFile.Close()
+}
+
+// fileMode keeps the permission bits from the tarball, so executables stay
+// executable, but never grants group or world write access or special bits
+// and always leaves files readable.
+func fileMode(mode int64) os.FileMode {
+	return os.FileMode(mode)&0755 | 0644
+}
+
+// dirMode is like fileMode but keeps directories traversable and writable
+// by the owner so extraction can continue below them.
+func dirMode(mode int64) os.FileMode {
+	return os.FileMode(mode)&0755 | 0700
+}
@@ -0,0 +1,173 @@
+package pkg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+}
+
+func buildTarball(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Size:     int64(len(e.body)),
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.body))
+	}
+	tw.Close()
+	gzw.Close()
+	return buf.Bytes()
+}
+
+func extractEntries(t *testing.T, entries ...tarEntry) (string, error) {
+	t.Helper()
+	tarball := buildTarball(t, entries...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "node_modules", "pkg")
+	return dest, pkg.DownloadAndExtractTarball(srv.URL, dest, "")
+}
+
+func TestExtractRejectsUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"parent traversal", []tarEntry{{name: "package/../../evil.js", typeflag: tar.TypeReg, body: "x"}}},
+		{"absolute path", []tarEntry{{name: "/etc/evil", typeflag: tar.TypeReg, body: "x"}}},
+		{"drive letter", []tarEntry{{name: "C:/evil", typeflag: tar.TypeReg, body: "x"}}},
+		{"absolute symlink", []tarEntry{{name: "package/link", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}}},
+		{"escaping symlink", []tarEntry{{name: "package/lib/link", typeflag: tar.TypeSymlink, linkname: "../../../evil"}}},
+		{"write through symlink", []tarEntry{
+			{name: "package/up", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "package/up/file.js", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"escaping hardlink", []tarEntry{{name: "package/link", typeflag: tar.TypeLink, linkname: "package/../../secret"}}},
+		{"dangling hardlink", []tarEntry{{name: "package/link", typeflag: tar.TypeLink, linkname: "package/missing.js"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, err := extractEntries(t, tt.entries...)
+			if err == nil {
+				t.Fatalf("Expected unsafe tarball to be rejected")
+			}
+			if _, statErr := os.Stat(filepath.Join(dest, "..", "..", "evil.js")); statErr == nil {
+				t.Errorf("File written outside destination")
+			}
+		})
+	}
+}
+
+func TestExtractSafeLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+
+	dest, err := extractEntries(t,
+		tarEntry{name: "package/lib/index.js", typeflag: tar.TypeReg, body: "module.exports = 1"},
+		tarEntry{name: "package/index.js", typeflag: tar.TypeSymlink, linkname: "lib/index.js"},
+		tarEntry{name: "package/copy.js", typeflag: tar.TypeLink, linkname: "package/lib/index.js"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to extract tarball: %v", err)
+	}
+
+	for _, name := range []string{"index.js", "copy.js"} {
+		content, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(content) != "module.exports = 1" {
+			t.Errorf("Unexpected content for %s: %q (%v)", name, content, err)
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.Set("tarball-max-size", "10")
+	_, err := extractEntries(t, tarEntry{name: "package/big.js", typeflag: tar.TypeReg, body: strings.Repeat("x", 11)})
+	if err == nil || !strings.Contains(err.Error(), "more than 10 bytes") {
+		t.Errorf("Expected size limit error, got %v", err)
+	}
+
+	cfg.Set("tarball-max-size", "")
+	cfg.Set("tarball-max-files", "2")
+	_, err = extractEntries(t,
+		tarEntry{name: "package/a.js", typeflag: tar.TypeReg, body: "a"},
+		tarEntry{name: "package/b.js", typeflag: tar.TypeReg, body: "b"},
+		tarEntry{name: "package/c.js", typeflag: tar.TypeReg, body: "c"},
+	)
+	if err == nil || !strings.Contains(err.Error(), "more than 2 entries") {
+		t.Errorf("Expected file count limit error, got %v", err)
+	}
+}
+
+func TestExtractPreservesModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no executable bits")
+	}
+
+	dest, err := extractEntries(t,
+		tarEntry{name: "package/bin/", typeflag: tar.TypeDir, mode: 0750},
+		tarEntry{name: "package/bin/cli.js", typeflag: tar.TypeReg, body: "#!/usr/bin/env node", mode: 0755},
+		tarEntry{name: "package/prebuilt", typeflag: tar.TypeReg, body: "\x7fELF", mode: 04777},
+		tarEntry{name: "package/index.js", typeflag: tar.TypeReg, body: "", mode: 0666},
+		tarEntry{name: "package/private.js", typeflag: tar.TypeReg, body: "", mode: 0600},
+	)
+	if err != nil {
+		t.Fatalf("Failed to extract tarball: %v", err)
+	}
+
+	tests := map[string]os.FileMode{
+		"bin":        os.ModeDir | 0750,
+		"bin/cli.js": 0755,
+		"prebuilt":   0755,
+		"index.js":   0644,
+		"private.js": 0644,
+	}
+	for name, want := range tests {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("Missing %s: %v", name, err)
+			continue
+		}
+		if got := info.Mode() & (os.ModeDir | os.ModePerm | os.ModeSetuid); got != want {
+			t.Errorf("Mode of %s = %v, want %v", name, got, want)
+		}
+	}
+}
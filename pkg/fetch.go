@@ -1,87 +1,219 @@
 package pkg
 
 import (
-	"archive/tar"
-	"compress/gzip"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
-	"strings"
+	"time"
 )
 
-func FetchPackageMeta(name string) (map[string]interface{}, error) {
-	url := "https://registry.npmjs.org/" + name
-	resp, err := HttpClient.Get(url)
+// FetchPackageMeta returns the abbreviated registry document of a package,
+// which is all that resolving and installing needs. Each package is fetched
+// at most once per process, and across runs the on-disk cache is used as
+// configured by the cache mode.
+func FetchPackageMeta(name string) (*Packument, error) {
+	return fetchPackageMeta(context.Background(), name)
+}
+
+func fetchPackageMeta(ctx context.Context, name string) (*Packument, error) {
+	url := Cfg.RegistryFor(name) + EscapePackageName(name)
+
+	metaMemoMu.Lock()
+	memoized, ok := metaMemo[url]
+	metaMemoMu.Unlock()
+	if ok {
+		return memoized, nil
+	}
+
+	body, err := fetchCached(ctx, url, acceptAbbreviated)
 	if err != nil {
-		return nil, err
+		return nil, packageNotFound(err, name)
 	}
-	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	result, err := decodePackument(name, body)
+	if err != nil {
 		return nil, err
 	}
+
+	metaMemoMu.Lock()
+	metaMemo[url] = result
+	metaMemoMu.Unlock()
 	return result, nil
 }
 
-func GetTarballURL(meta map[string]interface{}, version string) (string, error) {
-	versions := meta["versions"].(map[string]interface{})
-	verMeta, ok := versions[version].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("version %s not found", version)
+// FetchFullPackageMeta returns the complete registry document, for commands
+// that need more than installing does, like view.
+func FetchFullPackageMeta(name string) (*FullPackument, error) {
+	return fetchFullPackageMeta(context.Background(), name)
+}
+
+func fetchFullPackageMeta(ctx context.Context, name string) (*FullPackument, error) {
+	url := Cfg.RegistryFor(name) + EscapePackageName(name)
+	body, err := fetchCached(ctx, url, acceptFull)
+	if err != nil {
+		return nil, packageNotFound(err, name)
+	}
+	return decodeFullPackument(name, body)
+}
+
+// packageNotFound names the package in a 404 from its metadata URL.
+func packageNotFound(err error, name string) error {
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		notFound.Name = name
 	}
-	dist := verMeta["dist"].(map[string]interface{})
-	return dist["tarball"].(string), nil
+	return err
 }
 
-func DownloadAndExtractTarball(url, dest string) error {
-	resp, err := HttpClient.Get(url)
+func GetTarballURL(meta *Packument, version string) (string, error) {
+	verMeta, err := meta.Manifest(version)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer resp.Body.Close()
+	return Cfg.ReplaceRegistryHost(meta.Name, verMeta.Dist.Tarball), nil
+}
 
-	gzr, err := gzip.NewReader(resp.Body)
+// GetTarballIntegrity returns the SRI string published for a version,
+// derived from the legacy sha1 shasum when no integrity field is present.
+// An empty string means the registry offers nothing to verify against.
+func GetTarballIntegrity(meta *Packument, version string) (string, error) {
+	verMeta, err := meta.Manifest(version)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if verMeta.Dist.Integrity != "" {
+		return verMeta.Dist.Integrity, nil
 	}
-	defer gzr.Close()
+	if verMeta.Dist.Shasum != "" {
+		return IntegrityFromShasum(verMeta.Dist.Shasum)
+	}
+	return "", nil
+}
 
-	tr := tar.NewReader(gzr)
+// redactURL drops any user:password part so credentials never end up in the
+// lockfile.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
+// DownloadAndExtractTarball extracts the tarball at url into dest. The
+// package is unpacked into a temporary sibling directory and only renamed
+// into place once it is complete and, when integrity is set, verified, so an
+// interrupted download never leaves a half-populated dest behind.
+func DownloadAndExtractTarball(url, dest, integrity string) error {
+	return downloadAndExtractTarball(context.Background(), url, dest, integrity)
+}
+
+// A download cut short, by a reset connection or fetch-timeout, is retried
+// from the start like failed requests are.
+func downloadAndExtractTarball(ctx context.Context, url, dest, integrity string) error {
+	if Cfg.CacheMode() == CacheOffline {
+		return &NotCachedError{URL: url}
+	}
+
+	policy := Cfg.retryPolicy()
+	for attempt := 0; ; attempt++ {
+		err := extractDownload(ctx, url, dest, integrity)
+		var interrupted *interruptedError
+		if !errors.As(err, &interrupted) || attempt >= policy.retries {
+			return err
+		}
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
+}
+
+// interruptedError is a download that failed while reading the body.
+type interruptedError struct {
+	url string
+	err error
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("download of %s interrupted: %v", redactURL(e.url), e.err)
+}
+
+func (e *interruptedError) Unwrap() error {
+	return e.err
+}
+
+// readTracker remembers the error reading from r failed with, which the
+// readers on top of it may report differently.
+type readTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+func extractDownload(ctx context.Context, url, dest, integrity string) error {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	tracker := &readTracker{r: resp.Body}
+	err = extractVerified(tracker, url, dest, integrity)
+	if err != nil && tracker.err != nil && ctx.Err() == nil {
+		return &interruptedError{url: url, err: tracker.err}
+	}
+	return err
+}
+
+// extractVerified extracts the tarball read from body into dest through a
+// staging directory, checking integrity if set.
+func extractVerified(body io.Reader, url, dest, integrity string) error {
+	var err error
+	var verifier *integrityVerifier
+	if integrity != "" {
+		verifier, err = newIntegrityVerifier(integrity)
 		if err != nil {
 			return err
 		}
+		body = io.TeeReader(body, verifier)
+	}
 
-		parts := strings.SplitN(hdr.Name, "/", 2)
-		if len(parts) < 2 {
-			continue
+	tmp, err := makeTempDir(dest)
+	if err != nil {
+		return err
+	}
+	if err := extractTarball(body, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if verifier != nil {
+		// Hash whatever the tar reader left unread, such as trailing padding
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			os.RemoveAll(tmp)
+			return err
 		}
-		relPath := parts[1]
-		target := filepath.Join(dest, relPath)
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			os.MkdirAll(target, 0755)
-		case tar.TypeReg:
-			os.MkdirAll(filepath.Dir(target), 0755)
-			outFile, err := os.Create(target)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				return err
-			}
-			outFile.Close()
+		if err := verifier.verify(url); err != nil {
+			os.RemoveAll(tmp)
+			return err
 		}
 	}
-	return nil
+	return replaceDir(tmp, dest)
 }
@@ -1,23 +1,52 @@
 package pkg_test
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
 )
 
 func TestFetchPackageMeta(t *testing.T) {
-	meta, err := pkg.FetchPackageMeta("is-even")
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "is-even", Version: "1.0.0", Dependencies: map[string]string{"is-odd": "^0.1.2"}},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+
+	meta, err := pkg.NewRegistry().Packument(t.Context(), "is-even")
 	if err != nil {
 		t.Fatalf("Failed to fetch package metadata: %v", err)
 	}
-	if _, ok := meta["name"]; !ok {
-		t.Errorf("Package metadata does not contain 'name'")
+	if meta.Name != "is-even" {
+		t.Errorf("Unexpected package name %q", meta.Name)
+	}
+	manifest, err := meta.Manifest("1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to decode manifest: %v", err)
+	}
+	if dep := manifest.Dependencies["is-odd"]; dep != "^0.1.2" {
+		t.Errorf("Dependencies not decoded, got %q", dep)
+	}
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "does-not-exist"); err == nil {
+		t.Errorf("Expected error for unknown package")
 	}
 }
 
 func TestGetTarballURL(t *testing.T) {
-	meta, err := pkg.FetchPackageMeta("lodash")
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "lodash", Version: "1.0.0"},
+		registrytest.Package{Name: "lodash", Version: "4.17.21"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+
+	meta, err := pkg.NewRegistry().Packument(t.Context(), "lodash")
 	if err != nil {
 		t.Fatalf("Failed to fetch package metadata: %v", err)
 	}
@@ -26,7 +55,53 @@ func TestGetTarballURL(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get tarball URL: %v", err)
 	}
-	if url == "" {
-		t.Errorf("Empty tarball URL returned")
+	if url != reg.TarballURL("lodash", version) {
+		t.Errorf("Unexpected tarball URL %s", url)
+	}
+}
+
+func TestCredentialsOnlySentToMatchingHost(t *testing.T) {
+	tarball := registrytest.Tarball(map[string]string{"package.json": `{"name":"@ourco/widgets"}`})
+
+	var tarballAuth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tarballAuth = r.Header.Get("Authorization")
+		w.Write(tarball)
+	}))
+	defer cdn.Close()
+
+	var metaAuth, metaPath string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metaAuth = r.Header.Get("Authorization")
+		metaPath = r.RequestURI
+		fmt.Fprintf(w, `{"name":"@ourco/widgets","versions":{"1.0.0":{"dist":{"tarball":%q}}}}`, cdn.URL+"/widgets-1.0.0.tgz")
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http:")
+	cfg := useTestConfig(t)
+	cfg.Set("@ourco:registry", registry.URL)
+	cfg.Set(host+"/:_authToken", "s3cret")
+
+	meta, err := pkg.FetchPackageMeta("@ourco/widgets")
+	if err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+	url, err := pkg.GetTarballURL(meta, "1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to get tarball URL: %v", err)
+	}
+	if err := pkg.DownloadAndExtractTarball(url, t.TempDir(), ""); err != nil {
+		t.Fatalf("Failed to download tarball: %v", err)
+	}
+
+	if metaPath != "/@ourco%2Fwidgets" {
+		t.Errorf("Scoped name not escaped in registry URL: %s", metaPath)
+	}
+	if metaAuth != "Bearer s3cret" {
+		t.Errorf("Registry did not receive token, got %q", metaAuth)
+	}
+	if tarballAuth != "" {
+		t.Errorf("Token leaked to another host: %q", tarballAuth)
 	}
 }
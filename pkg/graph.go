@@ -0,0 +1,511 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Graph is the planned node_modules tree of a project. Its nodes are
+// nested the way their directories are, and each one knows which node its
+// dependencies resolve to.
+type Graph struct {
+	Root *Node
+	// PeerConflicts lists the peer dependencies left unsatisfied
+	PeerConflicts []PeerConflict
+	// OptionalFailures lists the optional dependencies that could not be
+	// resolved or installed and were skipped
+	OptionalFailures []error
+	// UnmetDependencies lists the dependencies left loading a version
+	// they do not accept, to break dependency cycles
+	UnmetDependencies []UnmetDependency
+}
+
+// UnmetDependency is a dependency the version Node.js loads for it does not
+// satisfy.
+type UnmetDependency struct {
+	Dependent *Node
+	Name      string
+	Range     string
+	// Found is the version loaded instead
+	Found *Node
+}
+
+func (d UnmetDependency) String() string {
+	return fmt.Sprintf("%s wants %s@%s, but loads %s from %s", d.Dependent, d.Name, d.Range, d.Found, d.Found.Dir())
+}
+
+// Node is a package placed in the tree, or the project itself at the root.
+// Name is the directory it is installed in, which for a package installed
+// under an npm: alias differs from PackageName, the name it is published
+// under.
+type Node struct {
+	Name        string
+	PackageName string
+	Version     string
+	Resolved    string
+	Integrity   string
+	// Dependencies are the dependencies declared by the package
+	Dependencies         map[string]string
+	OptionalDependencies map[string]string
+	PeerDependencies     map[string]string
+	PeerDependenciesMeta map[string]PeerDependencyMeta
+	OS, CPU, Libc        []string
+	// Bundled are the dependencies shipped in the package's tarball. They
+	// are in the graph as its children, but only by name.
+	Bundled []string
+	// InBundle is set for packages shipped in their parent's tarball, which
+	// are not installed on their own nor recorded in the lockfile
+	InBundle bool
+	// Dev is set for packages only devDependencies need
+	Dev bool
+	// Optional is set for packages only optionalDependencies need
+	Optional bool
+	// skipped is set while installing for optional packages that do not
+	// fit the platform or failed to install
+	skipped bool
+
+	Parent *Node
+	// Children are the packages in the node's own node_modules
+	Children map[string]*Node
+	// Edges maps each dependency to the node Node.js will load for it
+	Edges map[string]*Node
+}
+
+func newNode(name, version string) *Node {
+	return &Node{
+		Name:     name,
+		Version:  version,
+		Children: make(map[string]*Node),
+		Edges:    make(map[string]*Node),
+	}
+}
+
+// nodeFromLock makes a node for the lockfile entry of name.
+func nodeFromLock(name string, dep LockedDependency) *Node {
+	node := newNode(name, dep.Version)
+	node.Resolved = dep.Resolved
+	node.Integrity = dep.Integrity
+	node.Dependencies = dep.Requires
+	node.OptionalDependencies = dep.OptionalDependencies
+	node.PeerDependencies = dep.PeerDependencies
+	node.PeerDependenciesMeta = dep.PeerDependenciesMeta
+	node.OS, node.CPU, node.Libc = dep.OS, dep.CPU, dep.Libc
+	node.Bundled = dep.BundleDependencies
+	if dep.Name != name {
+		node.PackageName = dep.Name
+	}
+	return node
+}
+
+// nodeFromManifest makes a node for a version of a package in the registry.
+func nodeFromManifest(name, version string, manifest *VersionManifest) *Node {
+	node := newNode(name, version)
+	node.Dependencies = manifest.Dependencies
+	node.OptionalDependencies = manifest.OptionalDependencies
+	node.PeerDependencies = manifest.PeerDependencies
+	node.PeerDependenciesMeta = manifest.PeerDependenciesMeta
+	node.OS, node.CPU, node.Libc = manifest.OS, manifest.CPU, manifest.Libc
+	node.Bundled = manifest.Bundled()
+	return node
+}
+
+// registryName is the name the package is published under.
+func (n *Node) registryName() string {
+	if n.PackageName != "" {
+		return n.PackageName
+	}
+	return n.Name
+}
+
+// tarballURL is where the node's tarball is downloaded from. Resolved may
+// come from a lockfile written for another registry, so it is pointed at
+// the configured one like URLs fresh from the registry are.
+func (n *Node) tarballURL() string {
+	return Cfg.ReplaceRegistryHost(n.registryName(), n.Resolved)
+}
+
+// matches reports whether the node is a package and version spec accepts,
+// following aliases.
+func (n *Node) matches(spec *PackageSpec) bool {
+	target := spec.Target()
+	return n.registryName() == target.Name && satisfies(n.Version, target.FetchSpec)
+}
+
+// same reports whether two nodes are the same version of the same package.
+func (n *Node) same(other *Node) bool {
+	return n.registryName() == other.registryName() && n.Version == other.Version
+}
+
+// dependencySpec is the range the node asks for name in, whichever kind of
+// dependency it is.
+func (n *Node) dependencySpec(name string) string {
+	if spec, ok := n.OptionalDependencies[name]; ok {
+		return spec
+	}
+	if spec, ok := n.Dependencies[name]; ok {
+		return spec
+	}
+	return n.PeerDependencies[name]
+}
+
+// Path is the location of the node relative to node_modules, like
+// "a/node_modules/@scope/b", with forward slashes on every platform. The
+// root's path is "".
+func (n *Node) Path() string {
+	if n.Parent == nil {
+		return ""
+	}
+	return childPath(n.Parent.Path(), n.Name)
+}
+
+// Dir is the directory the package is installed in.
+func (n *Node) Dir() string {
+	return filepath.Join("node_modules", filepath.FromSlash(n.Path()))
+}
+
+// Lookup finds name the way Node.js does from inside the package: in its
+// own node_modules, then in the node_modules of each package above it.
+func (n *Node) Lookup(name string) *Node {
+	for dir := n; dir != nil; dir = dir.Parent {
+		if child, ok := dir.Children[name]; ok {
+			return child
+		}
+	}
+	return nil
+}
+
+// addChild places child in the node's node_modules, along with the packages
+// it bundles.
+func (n *Node) addChild(child *Node) {
+	child.Parent = n
+	n.Children[child.Name] = child
+	for _, name := range child.Bundled {
+		bundled := newNode(name, "")
+		bundled.InBundle = true
+		child.addChild(bundled)
+	}
+}
+
+func (n *Node) String() string {
+	if n.Parent == nil {
+		return "the project"
+	}
+	if n.PackageName != "" {
+		return n.Name + "@npm:" + n.PackageName + "@" + n.Version
+	}
+	return n.Name + "@" + n.Version
+}
+
+// Nodes returns every package in the graph, parents before the packages
+// nested in them and otherwise sorted by path.
+func (g *Graph) Nodes() []*Node {
+	var nodes []*Node
+	level := []*Node{g.Root}
+	for len(level) > 0 {
+		var next []*Node
+		for _, node := range level {
+			for _, name := range sortedKeys(node.Children) {
+				next = append(next, node.Children[name])
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return next[i].Path() < next[j].Path() })
+		nodes = append(nodes, next...)
+		level = next
+	}
+	return nodes
+}
+
+// Find returns the node installed at path.
+func (g *Graph) Find(path string) *Node {
+	node := g.Root
+	for path != "" {
+		name, rest, _ := strings.Cut(path, nodeModulesSep)
+		if node = node.Children[name]; node == nil {
+			return nil
+		}
+		path = rest
+	}
+	return node
+}
+
+// Lock returns the lockfile entries of the graph, split into the packages
+// dependencies need and those only devDependencies need.
+func (g *Graph) Lock() (map[string]LockedDependency, map[string]LockedDependency) {
+	lock := make(map[string]LockedDependency)
+	devLock := make(map[string]LockedDependency)
+	for _, node := range g.Nodes() {
+		if node.InBundle {
+			continue
+		}
+		entry := LockedDependency{
+			Name:      node.PackageName,
+			Version:   node.Version,
+			Resolved:  redactURL(node.Resolved),
+			Integrity: node.Integrity,
+			Requires:  node.Dependencies,
+
+			OptionalDependencies: node.OptionalDependencies,
+			PeerDependencies:     node.PeerDependencies,
+			PeerDependenciesMeta: node.PeerDependenciesMeta,
+			Optional:             node.Optional,
+			OS:                   node.OS,
+			CPU:                  node.CPU,
+			Libc:                 node.Libc,
+			BundleDependencies:   node.Bundled,
+		}
+		if entry.Requires == nil {
+			entry.Requires = map[string]string{}
+		}
+		if node.Dev {
+			devLock[node.Path()] = entry
+		} else {
+			lock[node.Path()] = entry
+		}
+	}
+	return lock, devLock
+}
+
+// markDev flags the packages not reachable from the root's dependencies
+// named in prod.
+func (g *Graph) markDev(prod []string) {
+	used := make(map[*Node]bool)
+	var queue []*Node
+	for _, name := range prod {
+		if node := g.Root.Edges[name]; node != nil {
+			queue = append(queue, node)
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if used[node] {
+			continue
+		}
+		used[node] = true
+		for _, dep := range node.Edges {
+			queue = append(queue, dep)
+		}
+	}
+	for _, node := range g.Nodes() {
+		node.Dev = !used[node]
+	}
+}
+
+// markOptional flags the packages the root only reaches through optional
+// dependencies.
+func (g *Graph) markOptional() {
+	required := make(map[*Node]bool)
+	queue := []*Node{g.Root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for name, dep := range node.Edges {
+			if _, ok := node.OptionalDependencies[name]; ok || required[dep] {
+				continue
+			}
+			required[dep] = true
+			queue = append(queue, dep)
+		}
+	}
+	for _, node := range g.Nodes() {
+		node.Optional = !required[node]
+	}
+}
+
+// brokenBy returns the packages that cannot work when those in failed do
+// not: failed itself, and those requiring any of them through other than
+// an optional dependency.
+func (g *Graph) brokenBy(failed []*Node) map[*Node]bool {
+	broken := make(map[*Node]bool)
+	for _, node := range failed {
+		broken[node] = true
+	}
+	for changed := len(failed) > 0; changed; {
+		changed = false
+		for _, node := range g.Nodes() {
+			if broken[node] {
+				continue
+			}
+			for name, dep := range node.Edges {
+				if _, ok := node.OptionalDependencies[name]; !ok && broken[dep] {
+					broken[node] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return broken
+}
+
+// prune removes the broken packages from the graph, along with those
+// nothing else needs anymore.
+func (g *Graph) prune(broken map[*Node]bool) {
+	if len(broken) == 0 {
+		return
+	}
+	for _, node := range append(g.Nodes(), g.Root) {
+		for name, dep := range node.Edges {
+			if broken[dep] {
+				delete(node.Edges, name)
+			}
+		}
+	}
+	reached := make(map[*Node]bool)
+	queue := []*Node{g.Root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, dep := range node.Edges {
+			if !reached[dep] {
+				reached[dep] = true
+				queue = append(queue, dep)
+			}
+		}
+	}
+	for _, node := range g.Nodes() {
+		// Bundled packages go with the package shipping them
+		if !reached[node] && !node.InBundle {
+			delete(node.Parent.Children, node.Name)
+		}
+	}
+}
+
+// skipUnsupported skips the optional packages that do not fit the platform.
+// A required one that does not is a PlatformError.
+func (g *Graph) skipUnsupported(platform Platform) error {
+	for _, node := range g.Nodes() {
+		if platform.supports(node) {
+			continue
+		}
+		if !node.Optional {
+			return &PlatformError{Package: node, Platform: platform}
+		}
+		node.skipped = true
+	}
+	return nil
+}
+
+// installable returns the packages to install, parents first: those the
+// root reaches without going through a skipped package.
+func (g *Graph) installable() []*Node {
+	reached := make(map[*Node]bool)
+	queue := []*Node{g.Root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, dep := range node.Edges {
+			if dep.skipped || dep.InBundle || reached[dep] {
+				continue
+			}
+			reached[dep] = true
+			queue = append(queue, dep)
+		}
+	}
+	var nodes []*Node
+	for _, node := range g.Nodes() {
+		if reached[node] {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// LockGraph rebuilds the graph recorded in a lockfile, for installing it
+// as is.
+func LockGraph(lock *PackageLock) (*Graph, error) {
+	g := &Graph{Root: newNode(lock.Name, lock.Version)}
+	entries := make(map[string]LockedDependency)
+	dev := make(map[string]bool)
+	for path, dep := range lock.DevLock {
+		entries[path] = dep
+		dev[path] = true
+	}
+	for path, dep := range lock.Lockfile {
+		entries[path] = dep
+		delete(dev, path)
+	}
+
+	// Parents first, so every package can be attached to its parent
+	paths := sortedKeys(entries)
+	sort.SliceStable(paths, func(i, j int) bool {
+		return strings.Count(paths[i], nodeModulesSep) < strings.Count(paths[j], nodeModulesSep)
+	})
+	for _, path := range paths {
+		parent := g.Find(parentPath(path))
+		if parent == nil {
+			return nil, fmt.Errorf("lockfile entry %s is nested in %s, which is not in the lockfile", path, parentPath(path))
+		}
+		dep := entries[path]
+		node := nodeFromLock(packageName(path), dep)
+		node.Dev = dev[path]
+		node.Optional = dep.Optional
+		parent.addChild(node)
+	}
+
+	// The lockfile does not record what the project itself depends on. All
+	// packages at the top are taken as needed, except optional ones other
+	// packages depend on, which are only needed through them.
+	dependedOn := make(map[string]bool)
+	for _, dep := range entries {
+		for _, deps := range []map[string]string{dep.Requires, dep.OptionalDependencies, dep.PeerDependencies} {
+			for name := range deps {
+				dependedOn[name] = true
+			}
+		}
+	}
+	for name, node := range g.Root.Children {
+		if !node.Optional || !dependedOn[name] {
+			g.Root.Edges[name] = node
+		}
+	}
+	for _, node := range g.Nodes() {
+		for _, deps := range []map[string]string{node.Dependencies, node.OptionalDependencies, node.PeerDependencies} {
+			for name := range deps {
+				if dep := node.Lookup(name); dep != nil {
+					node.Edges[name] = dep
+				}
+			}
+		}
+	}
+	return g, nil
+}
+
+const nodeModulesSep = "/node_modules/"
+
+// childPath is where name is installed below the package at dir.
+func childPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + nodeModulesSep + name
+}
+
+// parentPath is the package whose node_modules holds the one at path.
+func parentPath(path string) string {
+	i := strings.LastIndex(path, nodeModulesSep)
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// packageName is the name of the package installed at path.
+func packageName(path string) string {
+	i := strings.LastIndex(path, nodeModulesSep)
+	if i < 0 {
+		return path
+	}
+	return path[i+len(nodeModulesSep):]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,81 +1,279 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/Masterminds/semver/v3"
 )
 
-var mu sync.Mutex
+// defaultWorkers is how many packages InstallPackage resolves and fetches
+// at once.
+const defaultWorkers = 5
 
-func InstallPackage(name, version string, lock map[string]LockedDependency, force bool) error {
-	if !force {
-		if _, exists := lock[name]; exists {
-			return nil
+// InstallPackage resolves version of name against reg and installs it at
+// the top of node_modules, with its dependencies. Versions already in lock
+// are kept when they satisfy, and lock is updated with every package
+// installed, keyed by location.
+func InstallPackage(ctx context.Context, reg Registry, name, version string, lock map[string]LockedDependency) error {
+	resolver := &Resolver{Registry: reg, Lock: &PackageLock{Lockfile: lock}}
+	g, err := resolver.Resolve(ctx, &PackageJSON{Dependencies: map[string]string{name: version}})
+	if err != nil {
+		// Offline misses are collected so the whole tree can be reported
+		// at once, but a partial tree is never linked
+		missing := &OfflineError{}
+		if !missing.add(err) {
+			return err
+		}
+		if err := Fetch(ctx, reg, g, defaultWorkers); !missing.add(err) {
+			return err
 		}
+		return missing
 	}
-
-	fmt.Println("Installing", name, version)
-	meta, err := FetchPackageMeta(name)
-	if err != nil {
+	if err := Install(ctx, reg, g, defaultWorkers); err != nil {
 		return err
 	}
 
-	resolvedVersion, err := resolveVersion(meta, version)
-	if err != nil {
-		return fmt.Errorf("error resolving %s@%s: %w", name, version, err)
+	installed, _ := g.Lock()
+	for path, dep := range installed {
+		lock[path] = dep
 	}
-	version = resolvedVersion
+	return nil
+}
 
-	tarballURL, err := GetTarballURL(meta, version)
-	if err != nil {
+// Install applies a graph: it fetches every package, then links them into
+// node_modules. Nothing is linked unless every package could be fetched.
+func Install(ctx context.Context, reg Registry, g *Graph, workers int) error {
+	if err := Fetch(ctx, reg, g, workers); err != nil {
 		return err
 	}
+	return Link(ctx, reg, g, workers)
+}
 
-	dest := filepath.Join("node_modules", name)
-	if err := DownloadAndExtractTarball(tarballURL, dest); err != nil {
+// Fetch adds the packages of the graph to the store, running up to workers
+// downloads at once. A tarball needed at several places in the tree is
+// downloaded once. Optional packages that do not fit Cfg.Platform are
+// skipped, as are those failing to download, which are reported in the
+// graph's OptionalFailures, and a required one that does not fit is a
+// PlatformError. In offline mode it reports every other package
+// missing from the caches in a single OfflineError.
+func Fetch(ctx context.Context, reg Registry, g *Graph, workers int) error {
+	if err := g.skipUnsupported(Cfg.Platform()); err != nil {
 		return err
 	}
 
-	mu.Lock()
-	lock[name] = LockedDependency{
-		Version:  version,
-		Resolved: tarballURL,
+	// Packages without integrity are not stored and are downloaded when
+	// linking instead
+	var nodes []*Node
+	sharing := make(map[string][]*Node)
+	for _, node := range g.installable() {
+		if node.Integrity == "" {
+			continue
+		}
+		if len(sharing[node.Integrity]) == 0 {
+			nodes = append(nodes, node)
+		}
+		sharing[node.Integrity] = append(sharing[node.Integrity], node)
 	}
-	mu.Unlock()
 
-	// Create .bin executables
-	if err := CreateBinLinks(dest); err != nil {
+	store := DefaultStore()
+	var errMu sync.Mutex
+	missing := &OfflineError{}
+	var firstErr error
+	err := parallel(ctx, nodes, workers, func(node *Node) {
+		_, err := store.Ensure(ctx, reg, node.tarballURL(), node.Integrity)
+		err = offlineMiss(err, node.Name, node.Version)
+		if err == nil {
+			return
+		}
+		errMu.Lock()
+		defer errMu.Unlock()
+		if g.skipOptional(sharing[node.Integrity], err) {
+			return
+		}
+		if !missing.add(err) && firstErr == nil {
+			firstErr = fmt.Errorf("error fetching %s: %w", node, err)
+		}
+	})
+	if err != nil {
 		return err
 	}
-	verMeta := meta["versions"].(map[string]interface{})[version].(map[string]interface{})
-	if deps, ok := verMeta["dependencies"].(map[string]interface{}); ok {
-		for dep, ver := range deps {
-			if err := InstallPackage(dep, ver.(string), lock, force); err != nil {
-				return err
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(missing.Missing) > 0 {
+		return missing
+	}
+	return nil
+}
+
+// Link populates node_modules with the packages of the graph and creates
+// their bin links. Installing a package replaces its whole directory, so
+// the tree is linked one level at a time, each level with up to workers
+// packages at once, and bin links are created last in a fixed order.
+// Optional packages that fail are skipped like in Fetch.
+func Link(ctx context.Context, reg Registry, g *Graph, workers int) error {
+	if err := g.skipUnsupported(Cfg.Platform()); err != nil {
+		return err
+	}
+	nodes := g.installable()
+	installable := nodeSet(nodes)
+	for len(nodes) > 0 {
+		depth := strings.Count(nodes[0].Path(), nodeModulesSep)
+		n := 1
+		for n < len(nodes) && strings.Count(nodes[n].Path(), nodeModulesSep) == depth {
+			n++
+		}
+		var level []*Node
+		for _, node := range nodes[:n] {
+			if installable[node] {
+				level = append(level, node)
 			}
 		}
+		nodes = nodes[n:]
+
+		for _, node := range level {
+			fmt.Println("Installing", node.Path(), node.Version)
+		}
+		var errMu sync.Mutex
+		var firstErr error
+		skipped := false
+		err := parallel(ctx, level, workers, func(node *Node) {
+			err := fetchPackage(ctx, reg, node.tarballURL(), node.Dir(), node.Integrity)
+			if err != nil {
+				errMu.Lock()
+				defer errMu.Unlock()
+				if g.skipOptional([]*Node{node}, err) {
+					skipped = true
+				} else if firstErr == nil {
+					firstErr = offlineMiss(err, node.Name, node.Version)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+		if skipped {
+			// Packages only needed by optional ones that failed are
+			// dropped too
+			installable = nodeSet(g.installable())
+		}
+	}
+
+	// Create .bin executables
+	for _, node := range g.installable() {
+		if err := CreateBinLinks(node.Dir()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func resolveVersion(meta map[string]interface{}, constraintStr string) (string, error) {
-	versionsMap := meta["versions"].(map[string]interface{})
+func nodeSet(nodes []*Node) map[*Node]bool {
+	set := make(map[*Node]bool, len(nodes))
+	for _, node := range nodes {
+		set[node] = true
+	}
+	return set
+}
+
+// skipOptional skips nodes, which share a tarball that failed to install,
+// if they are all optional, recording the failure. The packages requiring
+// them are skipped too. It reports whether they were.
+func (g *Graph) skipOptional(nodes []*Node, err error) bool {
+	for _, node := range nodes {
+		if !node.Optional {
+			return false
+		}
+	}
+	for node := range g.brokenBy(nodes) {
+		node.skipped = true
+	}
+	g.OptionalFailures = append(g.OptionalFailures, fmt.Errorf("%s: %w", nodes[0], err))
+	return true
+}
+
+// parallel calls fn for each node, at most workers at a time. It stops
+// starting new calls once ctx is done, and returns ctx's error then, after
+// the calls already started have returned.
+func parallel(ctx context.Context, nodes []*Node, workers int, fn func(node *Node)) error {
+	sem := make(chan struct{}, max(workers, 1))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(node)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
 
+// satisfies reports whether an installed version meets a semver range.
+func satisfies(version, constraint string) bool {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return false
+	}
+	v, err := semver.NewVersion(version)
+	return err == nil && c.Check(v)
+}
+
+// fetchPackage populates dest from the global store, adding the tarball to
+// the store first if needed. Packages without an integrity hash cannot be
+// addressed in the store and are extracted directly.
+func fetchPackage(ctx context.Context, reg Registry, tarballURL, dest, integrity string) error {
+	if integrity == "" {
+		return reg.Tarball(ctx, tarballURL, dest, "")
+	}
+	store := DefaultStore()
+	path, err := store.Ensure(ctx, reg, tarballURL, integrity)
+	if err != nil {
+		return err
+	}
+	return store.Link(path, dest)
+}
+
+// ResolveVersion picks the version of a package matching a dist-tag, an
+// exact version or the highest version satisfying a semver range.
+func ResolveVersion(meta *Packument, constraintStr string) (string, error) {
 	// Handle "latest" or "*"
 	if constraintStr == "latest" || constraintStr == "*" || constraintStr == "" {
-		distTags := meta["dist-tags"].(map[string]interface{})
-		return distTags["latest"].(string), nil
+		if _, ok := meta.DistTags["latest"]; ok {
+			return resolveTag(meta, "latest")
+		}
+		if constraintStr == "latest" {
+			return "", fmt.Errorf("%s has no latest dist-tag", meta.Name)
+		}
+		// Without a latest tag, "*" still matches the highest version
+		constraintStr = "*"
+	}
+
+	// Handle other dist-tags such as "next" or "beta"
+	if _, ok := meta.DistTags[constraintStr]; ok {
+		return resolveTag(meta, constraintStr)
 	}
 
 	// Try to parse as a constraint (handles ^, ~, >, <, and .x)
 	c, err := semver.NewConstraint(constraintStr)
 	if err == nil {
 		var validVersions []*semver.Version
-		for ver := range versionsMap {
+		for ver := range meta.Versions {
 			v, err := semver.NewVersion(ver)
 			if err == nil {
 				validVersions = append(validVersions, v)
@@ -86,15 +284,23 @@ func resolveVersion(meta map[string]interface{}, constraintStr string) (string,
 		// Find the highest version that matches the constraint
 		for i := len(validVersions) - 1; i >= 0; i-- {
 			if c.Check(validVersions[i]) {
-				return validVersions[i].String(), nil
+				return validVersions[i].Original(), nil
 			}
 		}
 	}
 
 	// Fallback: Exact match
-	if _, exists := versionsMap[constraintStr]; exists {
+	if _, exists := meta.Versions[constraintStr]; exists {
 		return constraintStr, nil
 	}
 
-	return "", fmt.Errorf("version %s not found", constraintStr)
+	return "", fmt.Errorf("no version of %s matches %s", meta.Name, constraintStr)
+}
+
+func resolveTag(meta *Packument, tag string) (string, error) {
+	version := meta.DistTags[tag]
+	if _, ok := meta.Versions[version]; !ok {
+		return "", fmt.Errorf("dist-tag %s of %s points to missing version %q", tag, meta.Name, version)
+	}
+	return version, nil
 }
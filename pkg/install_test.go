@@ -1,32 +1,358 @@
 package pkg_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"testing"
 
 	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
 )
 
 func TestInstallPackage(t *testing.T) {
-	tempDir, _ := os.MkdirTemp("", "npm-test")
-
-	os.MkdirAll(filepath.Join(tempDir, "node_modules"), 0755)
-	os.Chdir(tempDir)
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "lodash", Version: "4.17.20"},
+		registrytest.Package{Name: "lodash", Version: "4.17.21", Files: map[string]string{"lodash.js": "module.exports = {}"}},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	tempDir := t.TempDir()
+	t.Chdir(tempDir)
 
 	lock := make(map[string]pkg.LockedDependency)
-	err := pkg.InstallPackage("lodash", "4.17.21", lock, false)
+	err := pkg.InstallPackage(t.Context(), pkg.NewRegistry(), "lodash", "4.17.21", lock)
 	if err != nil {
 		t.Fatalf("Failed to install package: %v", err)
 	}
 
-	if _, ok := lock["lodash"]; !ok {
-		t.Errorf("Package not added to lock")
+	locked, ok := lock["lodash"]
+	if !ok {
+		t.Fatalf("Package not added to lock")
+	}
+	if locked.Version != "4.17.21" || locked.Resolved != reg.TarballURL("lodash", "4.17.21") || locked.Integrity == "" {
+		t.Errorf("Unexpected lock entry: %+v", locked)
 	}
 
 	// Check extracted files
-	pkgPath := filepath.Join(tempDir, "node_modules", "lodash")
+	pkgPath := filepath.Join(tempDir, "node_modules", "lodash", "lodash.js")
 	if _, err := os.Stat(pkgPath); os.IsNotExist(err) {
-		t.Errorf("Package directory not found: %v", pkgPath)
+		t.Errorf("Package file not found: %v", pkgPath)
+	}
+	if info, err := os.Stat(filepath.Dir(pkgPath)); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the package directory to be 0755, got %o", info.Mode().Perm())
+	}
+}
+
+func TestInstallPackageWithDependencies(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-lib", Version: "1.0.0", Dependencies: map[string]string{"@scope/helper": "^1.0.0"}},
+		registrytest.Package{Name: "@scope/helper", Version: "1.2.0"},
+		registrytest.Package{Name: "@scope/helper", Version: "2.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	lock := make(map[string]pkg.LockedDependency)
+	if err := pkg.InstallPackage(t.Context(), pkg.NewRegistry(), "app-lib", "latest", lock); err != nil {
+		t.Fatalf("Failed to install package: %v", err)
+	}
+	if got := lock["@scope/helper"].Version; got != "1.2.0" {
+		t.Errorf("Expected dependency @scope/helper@1.2.0, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join("node_modules", "@scope", "helper", "package.json")); err != nil {
+		t.Errorf("Dependency not extracted: %v", err)
+	}
+}
+
+func TestInstallPackageOffline(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-lib", Version: "1.0.0", Dependencies: map[string]string{"helper": "^1.0.0", "other": "^2.0.0"}},
+		registrytest.Package{Name: "helper", Version: "1.2.0"},
+		registrytest.Package{Name: "other", Version: "2.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	// Warm the caches with only part of the tree: helper completely and
+	// just the metadata of app-lib
+	if err := pkg.InstallPackage(t.Context(), pkg.NewRegistry(), "helper", "^1.0.0", make(map[string]pkg.LockedDependency)); err != nil {
+		t.Fatalf("Failed to install package: %v", err)
+	}
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "app-lib"); err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+	reg.Close()
+	pkg.ResetMetadataMemo()
+	os.RemoveAll("node_modules")
+	cfg.Set("offline", "true")
+
+	err := pkg.InstallPackage(t.Context(), pkg.NewRegistry(), "helper", "^1.0.0", make(map[string]pkg.LockedDependency))
+	if err != nil {
+		t.Fatalf("Cached package failed to install offline: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("node_modules", "helper", "package.json")); err != nil {
+		t.Errorf("Cached package not extracted offline: %v", err)
+	}
+
+	err = pkg.InstallPackage(t.Context(), pkg.NewRegistry(), "app-lib", "1.0.0", make(map[string]pkg.LockedDependency))
+	var offlineErr *pkg.OfflineError
+	if !errors.As(err, &offlineErr) {
+		t.Fatalf("Expected OfflineError, got %v", err)
+	}
+	sort.Strings(offlineErr.Missing)
+	want := []string{"app-lib@1.0.0", "other@^2.0.0"}
+	if !slices.Equal(offlineErr.Missing, want) {
+		t.Errorf("Missing = %v, want %v", offlineErr.Missing, want)
+	}
+}
+
+func TestInstallNestsConflictingVersions(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-a", Version: "1.0.0", Dependencies: map[string]string{"shared": "^1.0.0"}},
+		registrytest.Package{Name: "app-b", Version: "1.0.0", Dependencies: map[string]string{"shared": "^2.0.0"}},
+		registrytest.Package{Name: "shared", Version: "1.0.0", Dependencies: map[string]string{"leaf": "^1.0.0"}},
+		registrytest.Package{Name: "shared", Version: "2.0.0"},
+		registrytest.Package{Name: "leaf", Version: "1.0.0"},
+		registrytest.Package{Name: "leaf", Version: "2.0.0"},
+		registrytest.Package{Name: "tool", Version: "1.0.0", Dependencies: map[string]string{"shared": "^1.0.0"}},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	pkgJSON := &pkg.PackageJSON{
+		Dependencies:    map[string]string{"app-a": "^1.0.0", "app-b": "^1.0.0"},
+		DevDependencies: map[string]string{"leaf": "^2.0.0", "shared": "^2.0.0", "tool": "1.0.0"},
+	}
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve dependencies: %v", err)
+	}
+	if err := pkg.Install(t.Context(), registry, graph, 3); err != nil {
+		t.Fatalf("Failed to install dependencies: %v", err)
+	}
+	prod, dev := graph.Lock()
+
+	want := map[string]string{
+		"app-a":                     "1.0.0",
+		"app-b":                     "1.0.0",
+		"leaf":                      "2.0.0",
+		"shared":                    "2.0.0",
+		"tool":                      "1.0.0",
+		"app-a/node_modules/shared": "1.0.0",
+		"app-a/node_modules/leaf":   "1.0.0",
+		"tool/node_modules/shared":  "1.0.0",
+		"tool/node_modules/leaf":    "1.0.0",
+	}
+	got := make(map[string]string)
+	for path, dep := range prod {
+		got[path] = dep.Version
+	}
+	for path, dep := range dev {
+		got[path] = dep.Version
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("Unexpected tree:\n got %v\nwant %v", got, want)
+	}
+
+	for path, version := range want {
+		data, err := os.ReadFile(filepath.Join("node_modules", filepath.FromSlash(path), "package.json"))
+		if err != nil {
+			t.Errorf("%s not installed: %v", path, err)
+			continue
+		}
+		var manifest pkg.PackageJSON
+		json.Unmarshal(data, &manifest)
+		if manifest.Version != version {
+			t.Errorf("Expected %s@%s on disk, got %s", path, version, manifest.Version)
+		}
+	}
+
+	if len(prod) != 5 || len(dev) != 4 {
+		t.Errorf("Unexpected split, prod %v, dev %v", slices.Sorted(maps.Keys(prod)), slices.Sorted(maps.Keys(dev)))
+	}
+	if _, ok := dev["tool/node_modules/shared"]; !ok {
+		t.Errorf("Packages only tool needs should be dev dependencies: %v", slices.Sorted(maps.Keys(dev)))
+	}
+}
+
+func TestInstallDownloadsSharedTarballOnce(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-a", Version: "1.0.0", Dependencies: map[string]string{"shared": "^1.0.0"}},
+		registrytest.Package{Name: "app-b", Version: "1.0.0", Dependencies: map[string]string{"shared": "^1.0.0"}},
+		registrytest.Package{Name: "shared", Version: "1.0.0"},
+		registrytest.Package{Name: "shared", Version: "2.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"app-a": "^1.0.0", "app-b": "^1.0.0", "shared": "^2.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if err := pkg.Install(t.Context(), registry, graph, 4); err != nil {
+		t.Fatalf("Failed to install: %v", err)
+	}
+
+	for _, path := range []string{"app-a/node_modules/shared", "app-b/node_modules/shared"} {
+		if _, err := os.Stat(filepath.Join("node_modules", filepath.FromSlash(path), "package.json")); err != nil {
+			t.Errorf("%s not installed: %v", path, err)
+		}
+	}
+	if n := reg.Requests(registrytest.TarballPath("shared", "1.0.0")); n != 1 {
+		t.Errorf("Expected shared@1.0.0 to be downloaded once, got %d", n)
+	}
+}
+
+func TestInstallCancelled(t *testing.T) {
+	reg := registrytest.New(t, registrytest.Package{Name: "app-lib", Version: "1.0.0"})
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"app-lib": "^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := pkg.Install(ctx, registry, graph, 4); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("node_modules", "app-lib")); !os.IsNotExist(err) {
+		t.Errorf("Nothing should be installed after cancelling: %v", err)
+	}
+}
+
+func TestInstallBundledDependencies(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{
+			Name:               "cli",
+			Version:            "1.0.0",
+			Dependencies:       map[string]string{"helper": "^1.0.0", "plugin": "^1.0.0"},
+			BundleDependencies: []string{"helper"},
+			Files: map[string]string{
+				"node_modules/helper/package.json": `{"name":"helper","version":"1.0.0"}`,
+				"node_modules/helper/patched.js":   "module.exports = 'bundled'",
+			},
+		},
+		registrytest.Package{Name: "helper", Version: "1.0.0"},
+		registrytest.Package{Name: "helper", Version: "2.0.0"},
+		registrytest.Package{Name: "plugin", Version: "1.0.0", Dependencies: map[string]string{"helper": "^1.0.0"}},
+		registrytest.Package{Name: "plugin", Version: "2.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"cli": "^1.0.0", "helper": "^2.0.0", "plugin": "^2.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	// plugin@1 nested in cli loads the helper cli bundles
+	want := map[string]string{"cli": "1.0.0", "helper": "2.0.0", "plugin": "2.0.0", "cli/node_modules/plugin": "1.0.0"}
+	if got := treeVersions(graph); !maps.Equal(got, want) {
+		t.Errorf("Bundled dependencies should not be resolved:\n got %v\nwant %v", got, want)
+	}
+	checkBundledEdges := func(g *pkg.Graph) {
+		t.Helper()
+		bundled := g.Find("cli/node_modules/helper")
+		if bundled == nil || !bundled.InBundle {
+			t.Fatalf("Expected the bundled helper in the graph, got %+v", bundled)
+		}
+		for _, path := range []string{"cli", "cli/node_modules/plugin"} {
+			if got := g.Find(path).Edges["helper"]; got != bundled {
+				t.Errorf("%s should load the bundled helper, not %v", path, got)
+			}
+		}
+	}
+	checkBundledEdges(graph)
+	lockfile, devLock := graph.Lock()
+	if got := lockfile["cli"].BundleDependencies; !slices.Equal(got, []string{"helper"}) {
+		t.Errorf("Expected the bundled dependencies in the lockfile, got %v", got)
+	}
+
+	checkInstalled := func(g *pkg.Graph) {
+		t.Helper()
+		if err := pkg.Install(t.Context(), registry, g, 4); err != nil {
+			t.Fatalf("Failed to install: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join("node_modules", "cli", "node_modules", "helper", "patched.js")); err != nil {
+			t.Errorf("The bundled copy should be kept: %v", err)
+		}
+		data, _ := os.ReadFile(filepath.Join("node_modules", "helper", "package.json"))
+		var manifest pkg.PackageJSON
+		json.Unmarshal(data, &manifest)
+		if manifest.Version != "2.0.0" {
+			t.Errorf("Expected helper@2.0.0 at the top, got %q", manifest.Version)
+		}
+	}
+	checkInstalled(graph)
+
+	t.Chdir(t.TempDir())
+	locked, err := pkg.LockGraph(&pkg.PackageLock{Lockfile: lockfile, DevLock: devLock})
+	if err != nil {
+		t.Fatalf("Failed to read the lockfile: %v", err)
+	}
+	checkBundledEdges(locked)
+	checkInstalled(locked)
+
+	if n := reg.Requests(registrytest.TarballPath("helper", "1.0.0")); n != 0 {
+		t.Errorf("The bundled version should never be downloaded, got %d requests", n)
+	}
+}
+
+func TestInstallFromLockUsesConfiguredRegistry(t *testing.T) {
+	files := map[string]string{
+		"package.json": `{"name":"mirrored","version":"1.0.0"}`,
+		"index.js":     "module.exports = 1",
+	}
+	reg := registrytest.New(t, registrytest.Package{Name: "mirrored", Version: "1.0.0", Files: files})
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	// Locked while the public registry was configured, installed from a mirror
+	lock := &pkg.PackageLock{Lockfile: map[string]pkg.LockedDependency{
+		"mirrored": {
+			Version:   "1.0.0",
+			Resolved:  pkg.DefaultRegistry + "mirrored/-/mirrored-1.0.0.tgz",
+			Integrity: registrytest.Integrity(registrytest.Tarball(files)),
+			Requires:  map[string]string{},
+		},
+	}}
+	graph, err := pkg.LockGraph(lock)
+	if err != nil {
+		t.Fatalf("Failed to read the lockfile: %v", err)
+	}
+	if err := pkg.Install(t.Context(), pkg.NewRegistry(), graph, 4); err != nil {
+		t.Fatalf("Failed to install from the mirror: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("node_modules", "mirrored", "index.js")); err != nil {
+		t.Errorf("Package not installed: %v", err)
+	}
+	if n := reg.Requests(registrytest.TarballPath("mirrored", "1.0.0")); n != 1 {
+		t.Errorf("Expected 1 tarball request to the mirror, got %d", n)
 	}
 }
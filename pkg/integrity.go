@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Supported SRI algorithms, weakest first.
+var integrityAlgorithms = []string{"sha1", "sha256", "sha384", "sha512"}
+
+// Integrity is a single Subresource Integrity hash such as "sha512-...".
+type Integrity struct {
+	Algorithm string
+	Digest    []byte
+}
+
+// ParseIntegrity picks the strongest supported hash out of an SRI string.
+// Entries using unknown algorithms are ignored.
+func ParseIntegrity(sri string) (*Integrity, error) {
+	var best *Integrity
+	bestRank := -1
+	for _, entry := range strings.Fields(sri) {
+		algo, encoded, ok := strings.Cut(entry, "-")
+		if !ok {
+			continue
+		}
+		rank := algorithmRank(algo)
+		if rank <= bestRank {
+			continue
+		}
+		// Options after "?" are allowed by the SRI spec and ignored
+		encoded, _, _ = strings.Cut(encoded, "?")
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integrity %q: %w", entry, err)
+		}
+		best, bestRank = &Integrity{Algorithm: algo, Digest: digest}, rank
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no supported hash in integrity %q", sri)
+	}
+	return best, nil
+}
+
+// IntegrityFromShasum converts a hex sha1 "shasum" from older registry
+// documents into an SRI string.
+func IntegrityFromShasum(shasum string) (string, error) {
+	digest, err := hex.DecodeString(shasum)
+	if err != nil || len(digest) != sha1.Size {
+		return "", fmt.Errorf("invalid shasum %q", shasum)
+	}
+	return "sha1-" + base64.StdEncoding.EncodeToString(digest), nil
+}
+
+func (i *Integrity) String() string {
+	return i.Algorithm + "-" + base64.StdEncoding.EncodeToString(i.Digest)
+}
+
+func (i *Integrity) newHash() hash.Hash {
+	switch i.Algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	default:
+		return sha512.New()
+	}
+}
+
+func algorithmRank(algo string) int {
+	for i, a := range integrityAlgorithms {
+		if a == algo {
+			return i
+		}
+	}
+	return -1
+}
+
+// IntegrityError reports a tarball whose contents do not match the
+// expected hash.
+type IntegrityError struct {
+	URL      string
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for %s: expected %s, got %s", e.URL, e.Expected, e.Actual)
+}
+
+// integrityVerifier hashes everything written to it and compares the result
+// against the expected integrity.
+type integrityVerifier struct {
+	expected *Integrity
+	hash     hash.Hash
+}
+
+func newIntegrityVerifier(sri string) (*integrityVerifier, error) {
+	expected, err := ParseIntegrity(sri)
+	if err != nil {
+		return nil, err
+	}
+	return &integrityVerifier{expected: expected, hash: expected.newHash()}, nil
+}
+
+func (v *integrityVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+func (v *integrityVerifier) verify(url string) error {
+	actual := &Integrity{Algorithm: v.expected.Algorithm, Digest: v.hash.Sum(nil)}
+	if !bytes.Equal(actual.Digest, v.expected.Digest) {
+		return &IntegrityError{URL: url, Expected: v.expected.String(), Actual: actual.String()}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package pkg_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestParseIntegrityPicksStrongest(t *testing.T) {
+	sha1Sum := sha1.Sum([]byte("data"))
+	sha512Sum := sha512.Sum512([]byte("data"))
+	sri := "sha1-" + base64.StdEncoding.EncodeToString(sha1Sum[:]) +
+		" sha512-" + base64.StdEncoding.EncodeToString(sha512Sum[:]) +
+		" md5-ignored"
+
+	integrity, err := pkg.ParseIntegrity(sri)
+	if err != nil {
+		t.Fatalf("Failed to parse integrity: %v", err)
+	}
+	if integrity.Algorithm != "sha512" {
+		t.Errorf("Expected sha512, got %s", integrity.Algorithm)
+	}
+
+	if _, err := pkg.ParseIntegrity("md5-abc"); err == nil {
+		t.Errorf("Expected error for unsupported algorithm")
+	}
+}
+
+func TestIntegrityFromShasum(t *testing.T) {
+	sum := sha1.Sum([]byte("data"))
+	sri, err := pkg.IntegrityFromShasum(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("Failed to convert shasum: %v", err)
+	}
+	if want := "sha1-" + base64.StdEncoding.EncodeToString(sum[:]); sri != want {
+		t.Errorf("Expected %s, got %s", want, sri)
+	}
+	if _, err := pkg.IntegrityFromShasum("not-hex"); err == nil {
+		t.Errorf("Expected error for invalid shasum")
+	}
+}
+
+func TestDownloadAndExtractTarballVerifiesIntegrity(t *testing.T) {
+	tarball := registrytest.Tarball(map[string]string{"index.js": "module.exports = 1"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	sum := sha512.Sum512(tarball)
+	good := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+	dest := filepath.Join(t.TempDir(), "pkg")
+	if err := pkg.DownloadAndExtractTarball(srv.URL, dest, good); err != nil {
+		t.Fatalf("Expected matching integrity to pass: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "index.js")); err != nil {
+		t.Errorf("Package not extracted: %v", err)
+	}
+
+	other := sha512.Sum512([]byte("tampered"))
+	bad := "sha512-" + base64.StdEncoding.EncodeToString(other[:])
+	dest = filepath.Join(t.TempDir(), "pkg")
+	err := pkg.DownloadAndExtractTarball(srv.URL, dest, bad)
+	var integrityErr *pkg.IntegrityError
+	if !errors.As(err, &integrityErr) {
+		t.Fatalf("Expected IntegrityError, got %v", err)
+	}
+	if integrityErr.Expected != bad || integrityErr.Actual != good {
+		t.Errorf("Unexpected error details: %v", integrityErr)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("Tampered package was left in place")
+	}
+}
@@ -10,7 +10,9 @@ type PackageJSON struct {
 	Version         string            `json:"version"`
 	Dependencies    map[string]string `json:"dependencies"`
 	DevDependencies map[string]string `json:"devDependencies"`
-	Scripts         map[string]string `json:"scripts"`
+	// OptionalDependencies are installed when possible
+	OptionalDependencies map[string]string `json:"optionalDependencies,omitempty"`
+	Scripts              map[string]string `json:"scripts"`
 }
 
 func LoadPackageJSON(path string) (*PackageJSON, error) {
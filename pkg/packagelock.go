@@ -12,9 +12,34 @@ type PackageLock struct {
 	DevLock  map[string]LockedDependency `json:"devDependencies"`
 }
 
+// LockedDependency is a package installed at the location keyed by its
+// entry, like "a/node_modules/b" for a nested one.
 type LockedDependency struct {
-	Version  string `json:"version"`
-	Resolved string `json:"resolved"`
+	// Name is the name the package is published under, only set when it
+	// is installed under an npm: alias
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version"`
+	Resolved  string `json:"resolved"`
+	Integrity string `json:"integrity,omitempty"`
+	// Requires lists the dependencies declared in the package's manifest,
+	// empty rather than missing for a package without any
+	Requires map[string]string `json:"requires,omitzero"`
+
+	OptionalDependencies map[string]string             `json:"optionalDependencies,omitempty"`
+	PeerDependencies     map[string]string             `json:"peerDependencies,omitempty"`
+	PeerDependenciesMeta map[string]PeerDependencyMeta `json:"peerDependenciesMeta,omitempty"`
+	// Optional is set for packages only optional dependencies need. They
+	// stay in the lockfile even when they do not fit the platform, so the
+	// lockfile works everywhere.
+	Optional bool `json:"optional,omitempty"`
+
+	OS   []string `json:"os,omitempty"`
+	CPU  []string `json:"cpu,omitempty"`
+	Libc []string `json:"libc,omitempty"`
+
+	// BundleDependencies are shipped in the package's tarball and have no
+	// entries of their own
+	BundleDependencies []string `json:"bundleDependencies,omitempty"`
 }
 
 func LoadPackageLock(path string) (*PackageLock, error) {
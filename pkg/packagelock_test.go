@@ -14,8 +14,9 @@ func TestPackageLockReadWrite(t *testing.T) {
 		Version: "1.0.0",
 		Lockfile: map[string]pkg.LockedDependency{
 			"axios": {
-				Version:  "1.2.0",
-				Resolved: "https://registry.npmjs.org/axios/-/axios-1.2.0.tgz",
+				Version:   "1.2.0",
+				Resolved:  "https://registry.npmjs.org/axios/-/axios-1.2.0.tgz",
+				Integrity: "sha512-dGVzdA==",
 			},
 		},
 		DevLock: map[string]pkg.LockedDependency{
@@ -40,6 +41,9 @@ func TestPackageLockReadWrite(t *testing.T) {
 	if loaded.Lockfile["axios"].Version != "1.2.0" {
 		t.Errorf("Lockfile entry not loaded correctly")
 	}
+	if loaded.Lockfile["axios"].Integrity != "sha512-dGVzdA==" {
+		t.Errorf("Lockfile integrity not loaded correctly")
+	}
 	if loaded.DevLock["eslint"].Resolved != original.DevLock["eslint"].Resolved {
 		t.Errorf("DevLock entry not loaded correctly")
 	}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Accept headers for the two registry document formats. The abbreviated
+// "corgi" format only carries what an install needs and is a fraction of the
+// size of the full document.
+const (
+	acceptAbbreviated = "application/vnd.npm.install-v1+json; q=1.0, application/json; q=0.8, */*"
+	acceptFull        = "application/json"
+)
+
+// Packument is the registry document describing all versions of a package.
+// Versions are only decoded by Manifest, so a malformed old version does not
+// keep the others from being installed.
+type Packument struct {
+	Name     string                     `json:"name"`
+	DistTags map[string]string          `json:"dist-tags"`
+	Versions map[string]json.RawMessage `json:"versions"`
+}
+
+// VersionManifest is the package.json of one published version as served
+// by the registry.
+type VersionManifest struct {
+	Name         string            `json:"name"`
+	Version      string            `json:"version"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+	Dist         Dist              `json:"dist"`
+
+	OptionalDependencies map[string]string             `json:"optionalDependencies,omitempty"`
+	PeerDependencies     map[string]string             `json:"peerDependencies,omitempty"`
+	PeerDependenciesMeta map[string]PeerDependencyMeta `json:"peerDependenciesMeta,omitempty"`
+
+	// OS, CPU and Libc restrict the platforms the package installs on
+	OS   []string `json:"os,omitempty"`
+	CPU  []string `json:"cpu,omitempty"`
+	Libc []string `json:"libc,omitempty"`
+
+	// BundleDependencies are shipped in the tarball's node_modules. Both
+	// spellings are accepted, like in npm.
+	BundleDependencies  BundleDependencies `json:"bundleDependencies,omitzero"`
+	BundledDependencies BundleDependencies `json:"bundledDependencies,omitzero"`
+}
+
+// Bundled returns the names of the dependencies shipped in the tarball,
+// sorted.
+func (m *VersionManifest) Bundled() []string {
+	bundle := m.BundleDependencies
+	if !bundle.All && len(bundle.Names) == 0 {
+		bundle = m.BundledDependencies
+	}
+	if !bundle.All {
+		return sortedNames(bundle.Names)
+	}
+	var names []string
+	for name := range m.Dependencies {
+		names = append(names, name)
+	}
+	for name := range m.OptionalDependencies {
+		if _, ok := m.Dependencies[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return sortedNames(names)
+}
+
+// BundleDependencies is the bundleDependencies field of a package.json:
+// a list of dependency names, or true to bundle all of them.
+type BundleDependencies struct {
+	All   bool
+	Names []string
+}
+
+func (b *BundleDependencies) UnmarshalJSON(data []byte) error {
+	var all bool
+	if err := json.Unmarshal(data, &all); err == nil {
+		*b = BundleDependencies{All: all}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("bundleDependencies must be a list of names or a boolean")
+	}
+	*b = BundleDependencies{Names: names}
+	return nil
+}
+
+func (b BundleDependencies) MarshalJSON() ([]byte, error) {
+	if b.All {
+		return []byte("true"), nil
+	}
+	return json.Marshal(b.Names)
+}
+
+type Dist struct {
+	Tarball   string `json:"tarball"`
+	Integrity string `json:"integrity,omitempty"`
+	Shasum    string `json:"shasum,omitempty"`
+}
+
+// FullPackument is the complete registry document, including fields the
+// abbreviated format leaves out such as readmes and publish times. Time maps
+// versions to when they were published, except for "unpublished", which is
+// an object. Document holds everything as decoded JSON for display.
+type FullPackument struct {
+	Packument
+	Time     map[string]interface{} `json:"time"`
+	Document map[string]interface{} `json:"-"`
+}
+
+// decodePackument parses and validates the document returned for name.
+func decodePackument(name string, body []byte) (*Packument, error) {
+	var meta Packument
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, fmt.Errorf("malformed registry metadata for %s: %w", name, err)
+	}
+	if err := meta.validate(name); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func decodeFullPackument(name string, body []byte) (*FullPackument, error) {
+	var full FullPackument
+	if err := json.Unmarshal(body, &full); err != nil {
+		return nil, fmt.Errorf("malformed registry metadata for %s: %w", name, err)
+	}
+	if _, ok := full.Time["unpublished"]; ok && len(full.Versions) == 0 {
+		return nil, fmt.Errorf("package %s was unpublished", name)
+	}
+	if err := full.validate(name); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &full.Document); err != nil {
+		return nil, err
+	}
+	return &full, nil
+}
+
+func (p *Packument) validate(name string) error {
+	if p.Name == "" {
+		return fmt.Errorf("malformed registry metadata for %s: missing package name", name)
+	}
+	if p.Name != name {
+		return fmt.Errorf("registry returned metadata for %s when asked for %s", p.Name, name)
+	}
+	if len(p.Versions) == 0 {
+		return fmt.Errorf("package %s has no published versions, it may have been unpublished", name)
+	}
+	return nil
+}
+
+// Manifest returns the manifest of a published version, checking that it
+// carries what is needed to download it.
+func (p *Packument) Manifest(version string) (*VersionManifest, error) {
+	data, ok := p.Versions[version]
+	if !ok {
+		return nil, fmt.Errorf("version %s of %s not found", version, p.Name)
+	}
+	var manifest VersionManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("malformed registry metadata for %s@%s: %w", p.Name, version, err)
+	}
+	if manifest.Dist.Tarball == "" {
+		return nil, fmt.Errorf("malformed registry metadata for %s@%s: missing dist.tarball", p.Name, version)
+	}
+	return &manifest, nil
+}
+
+func sortedNames(names []string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	names = slices.Clone(names)
+	slices.Sort(names)
+	return slices.Compact(names)
+}
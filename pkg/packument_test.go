@@ -0,0 +1,255 @@
+package pkg_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+// syntheticPackument builds a registry document with the given number of
+// versions. The full variant carries the fields the abbreviated format
+// drops, sized like those of popular packages.
+func syntheticPackument(versions int, full bool) []byte {
+	doc := map[string]interface{}{
+		"name":      "big-package",
+		"dist-tags": map[string]string{"latest": fmt.Sprintf("1.%d.0", versions-1)},
+	}
+	vers := make(map[string]interface{})
+	times := make(map[string]string)
+	for i := 0; i < versions; i++ {
+		v := fmt.Sprintf("1.%d.0", i)
+		manifest := map[string]interface{}{
+			"name":         "big-package",
+			"version":      v,
+			"dependencies": map[string]string{"tslib": "^2.0.0", "debug": "^4.0.0"},
+			"dist": map[string]string{
+				"tarball":   "https://registry.npmjs.org/big-package/-/big-package-" + v + ".tgz",
+				"integrity": "sha512-" + strings.Repeat("A", 86) + "==",
+				"shasum":    strings.Repeat("0", 40),
+			},
+		}
+		if full {
+			manifest["description"] = strings.Repeat("A package description. ", 10)
+			manifest["readme"] = strings.Repeat("Lorem ipsum dolor sit amet. ", 200)
+			manifest["scripts"] = map[string]string{"build": "tsc", "test": "jest", "lint": "eslint ."}
+			manifest["devDependencies"] = map[string]string{"typescript": "^5.0.0", "jest": "^29.0.0", "eslint": "^8.0.0"}
+			manifest["maintainers"] = []map[string]string{{"name": "someone", "email": "someone@example.com"}}
+			manifest["repository"] = map[string]string{"type": "git", "url": "git+https://github.com/example/big-package.git"}
+			manifest["gitHead"] = strings.Repeat("f", 40)
+			times[v] = "2024-01-01T00:00:00.000Z"
+		}
+		vers[v] = manifest
+	}
+	doc["versions"] = vers
+	if full {
+		doc["time"] = times
+		doc["readme"] = strings.Repeat("Lorem ipsum dolor sit amet. ", 500)
+	}
+	data, _ := json.Marshal(doc)
+	return data
+}
+
+func TestFetchPackageMetaUsesAbbreviatedFormat(t *testing.T) {
+	var accepts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		accepts = append(accepts, accept)
+		w.Write(syntheticPackument(3, !strings.HasPrefix(accept, "application/vnd.npm.install-v1+json")))
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+
+	meta, err := pkg.FetchPackageMeta("big-package")
+	if err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+	if got, _ := pkg.GetTarballURL(meta, "1.2.0"); !strings.HasSuffix(got, "big-package-1.2.0.tgz") {
+		t.Errorf("Unexpected tarball URL: %s", got)
+	}
+
+	full, err := pkg.FetchFullPackageMeta("big-package")
+	if err != nil {
+		t.Fatalf("Failed to fetch full package metadata: %v", err)
+	}
+	if full.Time["1.2.0"] == nil || full.Document["readme"] == nil {
+		t.Errorf("Full document is missing fields: time=%v", full.Time)
+	}
+
+	if len(accepts) != 2 || !strings.HasPrefix(accepts[0], "application/vnd.npm.install-v1+json") || accepts[1] != "application/json" {
+		t.Errorf("Unexpected Accept headers: %q", accepts)
+	}
+}
+
+func BenchmarkDecodeFullPackumentMap(b *testing.B) {
+	data := syntheticPackument(500, true)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var meta map[string]interface{}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeFullPackumentTyped(b *testing.B) {
+	data := syntheticPackument(500, true)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var meta pkg.Packument
+		if err := json.Unmarshal(data, &meta); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeAbbreviatedPackument(b *testing.B) {
+	data := syntheticPackument(500, false)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var meta pkg.Packument
+		if err := json.Unmarshal(data, &meta); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMalformedMetadataReturnsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		version string
+		wantErr string
+	}{
+		{"invalid json", `<html>Service Unavailable</html>`, "", "invalid JSON"},
+		{"versions not an object", `{"name":"broken","versions":[]}`, "", "malformed registry metadata"},
+		{"unpublished", `{"name":"broken","time":{"unpublished":{}}}`, "", "no published versions"},
+		{"missing name", `{"versions":{"1.0.0":{}}}`, "", "missing package name"},
+		{"wrong package", `{"name":"other","versions":{"1.0.0":{}}}`, "", "when asked for broken"},
+		{"missing dist", `{"name":"broken","dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{}}}`, "1.0.0", "missing dist.tarball"},
+		{"dangling dist-tag", `{"name":"broken","dist-tags":{"latest":"2.0.0"},"versions":{"1.0.0":{}}}`, "latest", "points to missing version"},
+		{"no latest tag", `{"name":"broken","versions":{"1.0.0":{}}}`, "latest", "no latest dist-tag"},
+		{"no match", `{"name":"broken","versions":{"1.0.0":{}}}`, "^2.0.0", "no version of broken matches ^2.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			cfg := useTestConfig(t)
+			cfg.Set("registry", srv.URL)
+
+			meta, err := pkg.FetchPackageMeta("broken")
+			if err == nil {
+				switch tt.version {
+				case "1.0.0":
+					_, err = pkg.GetTarballURL(meta, tt.version)
+				default:
+					_, err = pkg.ResolveVersion(meta, tt.version)
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestMalformedVersionOnlyFailsWhenPicked(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"old","dist-tags":{"latest":"2.0.0"},"versions":{
+			"1.0.0":{"dependencies":["a"],"dist":{"tarball":"http://example.com/old-1.0.0.tgz"}},
+			"2.0.0":{"dist":{"tarball":"http://example.com/old-2.0.0.tgz"}}}}`))
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+
+	meta, err := pkg.FetchPackageMeta("old")
+	if err != nil {
+		t.Fatalf("A malformed old version failed the whole document: %v", err)
+	}
+	version, err := pkg.ResolveVersion(meta, "latest")
+	if err != nil {
+		t.Fatalf("Failed to resolve latest: %v", err)
+	}
+	if _, err := pkg.GetTarballURL(meta, version); err != nil {
+		t.Errorf("Failed to read the well-formed version: %v", err)
+	}
+	if _, err := pkg.GetTarballURL(meta, "1.0.0"); err == nil || !strings.Contains(err.Error(), "malformed registry metadata for old@1.0.0") {
+		t.Errorf("Expected the malformed version to fail, got %v", err)
+	}
+}
+
+func TestFullPackumentUnpublished(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"gone","time":{"created":"2020-01-01T00:00:00.000Z","unpublished":{"time":"2021-01-01T00:00:00.000Z","versions":["1.0.0"]}}}`))
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+
+	_, err := pkg.FetchFullPackageMeta("gone")
+	if err == nil || !strings.Contains(err.Error(), "package gone was unpublished") {
+		t.Errorf("Expected an unpublished error, got %v", err)
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	meta := &pkg.Packument{
+		Name:     "lib",
+		DistTags: map[string]string{"latest": "1.2.0", "next": "2.0.0-beta.1"},
+		Versions: map[string]json.RawMessage{
+			"1.0.0": nil, "1.2.0": nil, "1.3.0": nil, "2.0.0-beta.1": nil,
+		},
+	}
+	tests := map[string]string{
+		"":       "1.2.0",
+		"*":      "1.2.0",
+		"latest": "1.2.0",
+		"next":   "2.0.0-beta.1",
+		"^1.0.0": "1.3.0",
+		"~1.0.0": "1.0.0",
+		"1.2.0":  "1.2.0",
+	}
+	for spec, want := range tests {
+		got, err := pkg.ResolveVersion(meta, spec)
+		if err != nil || got != want {
+			t.Errorf("ResolveVersion(%q) = %s, %v; want %s", spec, got, err, want)
+		}
+	}
+}
+
+func TestBundledDependencies(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     []string
+	}{
+		{manifest: `{"dependencies": {"a": "1", "b": "1"}}`},
+		{manifest: `{"dependencies": {"a": "1", "b": "1"}, "bundleDependencies": ["b"]}`, want: []string{"b"}},
+		{manifest: `{"dependencies": {"a": "1", "b": "1"}, "bundledDependencies": ["a"]}`, want: []string{"a"}},
+		{manifest: `{"dependencies": {"b": "1"}, "optionalDependencies": {"a": "1"}, "bundleDependencies": true}`, want: []string{"a", "b"}},
+		{manifest: `{"dependencies": {"a": "1"}, "bundleDependencies": false}`},
+	}
+	for _, tt := range tests {
+		var manifest pkg.VersionManifest
+		if err := json.Unmarshal([]byte(tt.manifest), &manifest); err != nil {
+			t.Errorf("Failed to decode %s: %v", tt.manifest, err)
+			continue
+		}
+		if got := manifest.Bundled(); !slices.Equal(got, tt.want) {
+			t.Errorf("Bundled() of %s = %v, want %v", tt.manifest, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	PeerDepsInstall = "install"
+	PeerDepsLegacy  = "legacy-peer-deps"
+	PeerDepsStrict  = "strict-peer-deps"
+)
+
+// PeerDependencyMeta qualifies a peer dependency. Optional peers are used
+// when present but never installed for the package.
+type PeerDependencyMeta struct {
+	Optional bool `json:"optional,omitempty"`
+}
+
+// PeerDepsMode tells how peer dependencies are handled: install adds the
+// missing ones and warns about conflicts, strict-peer-deps fails on
+// conflicts instead, and legacy-peer-deps ignores peer dependencies like
+// npm 6 did.
+func (c *Config) PeerDepsMode() string {
+	switch {
+	case c.Bool(PeerDepsLegacy):
+		return PeerDepsLegacy
+	case c.Bool(PeerDepsStrict):
+		return PeerDepsStrict
+	default:
+		return PeerDepsInstall
+	}
+}
+
+// PeerConflict is a peer dependency the version in place does not satisfy.
+type PeerConflict struct {
+	// Dependent is the package declaring the peer dependency
+	Dependent *Node
+	Peer      string
+	Range     string
+	// Found is the version the dependent gets instead
+	Found *Node
+}
+
+func (c PeerConflict) String() string {
+	return fmt.Sprintf("%s wants %s@%s as a peer, but %s is installed at %s",
+		c.Dependent, c.Peer, c.Range, c.Found, c.Found.Dir())
+}
+
+// PeerConflictError is returned in strict-peer-deps mode when some peer
+// dependencies are not satisfied.
+type PeerConflictError struct {
+	Conflicts []PeerConflict
+}
+
+func (e *PeerConflictError) Error() string {
+	lines := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		lines[i] = c.String()
+	}
+	return "conflicting peer dependencies:\n  " + strings.Join(lines, "\n  ")
+}
+
+// resolvePeer finds the node a peer dependency of node resolves to, the
+// version node sees. A missing or conflicting peer is added next to node,
+// where the package depending on node shares it, rather than inside it,
+// unless it is optional. When the peer cannot go there without replacing
+// or shadowing another version, the version node sees is kept and the
+// conflict is recorded. It reports whether the node was added.
+func (res *resolution) resolvePeer(node *Node, name, rawSpec string) (*Node, bool, error) {
+	spec, err := ResolvePackageSpec(name, rawSpec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	existing := node.Lookup(name)
+	if existing != nil && (existing.InBundle || existing.matches(spec)) {
+		return existing, false, nil
+	}
+	optional := node.PeerDependenciesMeta[name].Optional
+	if existing == nil && optional {
+		return nil, false, nil
+	}
+	conflict := func() (*Node, bool, error) {
+		res.peerConflicts = append(res.peerConflicts, PeerConflict{
+			Dependent: node,
+			Peer:      name,
+			Range:     spec.FetchSpec,
+			Found:     existing,
+		})
+		return existing, false, nil
+	}
+	if existing != nil && (optional || existing.Parent == node || existing.Parent == node.Parent) {
+		return conflict()
+	}
+
+	peer, err := res.pickVersion(node.Parent, name, spec.Target())
+	if err != nil {
+		return nil, false, err
+	}
+	// A peer found in an ancestor is shadowed by the version found instead,
+	// as for cycleTo in resolveDependency
+	if existing != nil && (shadows(node.Parent, peer) || cycleTo(node.Parent, peer) != nil) {
+		return conflict()
+	}
+	placeNode(node.Parent, peer).addChild(peer)
+	return peer, true, nil
+}
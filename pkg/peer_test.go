@@ -0,0 +1,190 @@
+package pkg_test
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestPeerDependencies(t *testing.T) {
+	plugin := func(version string, peers map[string]string, optional ...string) registrytest.Package {
+		return registrytest.Package{Name: "plugin", Version: version, PeerDependencies: peers, OptionalPeers: optional}
+	}
+	react := func(version string) registrytest.Package {
+		return registrytest.Package{Name: "react", Version: version}
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		packages  []registrytest.Package
+		direct    map[string]string
+		want      map[string]string
+		conflicts []string
+		wantErr   bool
+	}{
+		{
+			name:     "missing peer is installed",
+			packages: []registrytest.Package{plugin("1.0.0", map[string]string{"react": "^17.0.0"}), react("17.0.2"), react("18.2.0")},
+			direct:   map[string]string{"plugin": "^1.0.0"},
+			want:     map[string]string{"plugin": "1.0.0", "react": "17.0.2"},
+		},
+		{
+			name:     "peer provided by the project",
+			packages: []registrytest.Package{plugin("1.0.0", map[string]string{"react": ">=17.0.0"}), react("17.0.2"), react("18.2.0")},
+			direct:   map[string]string{"plugin": "^1.0.0", "react": "17.0.2"},
+			want:     map[string]string{"plugin": "1.0.0", "react": "17.0.2"},
+		},
+		{
+			name: "peer of a nested package goes next to it",
+			packages: []registrytest.Package{
+				{Name: "app", Version: "1.0.0", Dependencies: map[string]string{"plugin": "^1.0.0"}},
+				plugin("1.0.0", map[string]string{"react": "^17.0.0"}),
+				plugin("2.0.0", nil),
+				react("17.0.2"),
+				react("18.2.0"),
+			},
+			direct: map[string]string{"app": "^1.0.0", "plugin": "^2.0.0", "react": "^18.0.0"},
+			want: map[string]string{
+				"app": "1.0.0", "plugin": "2.0.0", "react": "18.2.0",
+				"app/node_modules/plugin": "1.0.0",
+				"app/node_modules/react":  "17.0.2",
+			},
+		},
+		{
+			name:      "conflicting peer is reported",
+			packages:  []registrytest.Package{plugin("1.0.0", map[string]string{"react": "^17.0.0"}), react("17.0.2"), react("18.2.0")},
+			direct:    map[string]string{"plugin": "^1.0.0", "react": "^18.0.0"},
+			want:      map[string]string{"plugin": "1.0.0", "react": "18.2.0"},
+			conflicts: []string{"plugin@1.0.0 wants react@^17.0.0 as a peer, but react@18.2.0 is installed at node_modules/react"},
+		},
+		{
+			name: "nested peer is not placed where it would shadow another version",
+			packages: []registrytest.Package{
+				{Name: "app", Version: "1.0.0", Dependencies: map[string]string{"other": "^1.0.0", "plugin": "^1.0.0"}},
+				{Name: "other", Version: "1.0.0", Dependencies: map[string]string{"react": "^18.0.0"}},
+				{Name: "other", Version: "2.0.0"},
+				plugin("1.0.0", map[string]string{"react": "^17.0.0"}),
+				plugin("2.0.0", nil),
+				react("17.0.2"),
+				react("18.2.0"),
+			},
+			direct: map[string]string{"app": "^1.0.0", "other": "^2.0.0", "plugin": "^2.0.0", "react": "^18.0.0"},
+			want: map[string]string{
+				"app": "1.0.0", "other": "2.0.0", "plugin": "2.0.0", "react": "18.2.0",
+				"app/node_modules/other":  "1.0.0",
+				"app/node_modules/plugin": "1.0.0",
+			},
+			conflicts: []string{"plugin@1.0.0 wants react@^17.0.0 as a peer, but react@18.2.0 is installed at node_modules/react"},
+		},
+		{
+			name:     "conflicting peer fails in strict mode",
+			mode:     pkg.PeerDepsStrict,
+			packages: []registrytest.Package{plugin("1.0.0", map[string]string{"react": "^17.0.0"}), react("17.0.2"), react("18.2.0")},
+			direct:   map[string]string{"plugin": "^1.0.0", "react": "^18.0.0"},
+			wantErr:  true,
+		},
+		{
+			name:     "peers are ignored in legacy mode",
+			mode:     pkg.PeerDepsLegacy,
+			packages: []registrytest.Package{plugin("1.0.0", map[string]string{"react": "^17.0.0", "dom": "^1.0.0"}), react("17.0.2"), react("18.2.0")},
+			direct:   map[string]string{"plugin": "^1.0.0", "react": "^18.0.0"},
+			want:     map[string]string{"plugin": "1.0.0", "react": "18.2.0"},
+		},
+		{
+			name:     "missing optional peer is not installed",
+			packages: []registrytest.Package{plugin("1.0.0", map[string]string{"react": "^17.0.0"}, "react"), react("17.0.2")},
+			direct:   map[string]string{"plugin": "^1.0.0"},
+			want:     map[string]string{"plugin": "1.0.0"},
+		},
+		{
+			name:      "conflicting optional peer is reported",
+			packages:  []registrytest.Package{plugin("1.0.0", map[string]string{"react": "^17.0.0"}, "react"), react("17.0.2"), react("18.2.0")},
+			direct:    map[string]string{"plugin": "^1.0.0", "react": "^18.0.0"},
+			want:      map[string]string{"plugin": "1.0.0", "react": "18.2.0"},
+			conflicts: []string{"plugin@1.0.0 wants react@^17.0.0 as a peer, but react@18.2.0 is installed at node_modules/react"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registrytest.New(t, tt.packages...)
+			cfg := useTestConfig(t)
+			cfg.Set("registry", reg.URL)
+			if tt.mode != "" {
+				cfg.Set(tt.mode, "true")
+			}
+
+			graph, err := (&pkg.Resolver{Registry: pkg.NewRegistry()}).Resolve(t.Context(), &pkg.PackageJSON{Dependencies: tt.direct})
+			if tt.wantErr {
+				var conflictErr *pkg.PeerConflictError
+				if !errors.As(err, &conflictErr) {
+					t.Fatalf("Expected a PeerConflictError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve: %v", err)
+			}
+			if got := treeVersions(graph); !maps.Equal(got, tt.want) {
+				t.Errorf("Unexpected tree:\n got %v\nwant %v", got, tt.want)
+			}
+			var conflicts []string
+			for _, c := range graph.PeerConflicts {
+				conflicts = append(conflicts, c.String())
+			}
+			if !slices.Equal(conflicts, tt.conflicts) {
+				t.Errorf("Unexpected conflicts:\n got %q\nwant %q", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestPeerDependenciesFromLockfile(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "plugin", Version: "1.0.0", PeerDependencies: map[string]string{"react": "^17.0.0"}},
+		registrytest.Package{Name: "react", Version: "17.0.2"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+
+	pkgJSON := &pkg.PackageJSON{Dependencies: map[string]string{"plugin": "^1.0.0"}}
+	resolver := &pkg.Resolver{Registry: pkg.NewRegistry()}
+	graph, err := resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	lockfile, devLock := graph.Lock()
+	if got := lockfile["plugin"].PeerDependencies["react"]; got != "^17.0.0" {
+		t.Errorf("Expected the peer range in the lockfile, got %q", got)
+	}
+	// The peer is only reachable through plugin, so it is not a dev dependency
+	if _, ok := lockfile["react"]; !ok {
+		t.Errorf("Expected react in dependencies, got %v", slices.Sorted(maps.Keys(lockfile)))
+	}
+
+	before := reg.Requests("/plugin") + reg.Requests("/react")
+	resolver.Lock = &pkg.PackageLock{Lockfile: lockfile, DevLock: devLock}
+	graph, err = resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve with the lockfile: %v", err)
+	}
+	if got := graph.Find("react"); got == nil || got.Version != "17.0.2" {
+		t.Errorf("Expected react@17.0.2 from the lockfile, got %v", got)
+	}
+	if after := reg.Requests("/plugin") + reg.Requests("/react"); after != before {
+		t.Errorf("Expected no metadata requests with a lockfile, got %d", after-before)
+	}
+
+	locked, err := pkg.LockGraph(resolver.Lock)
+	if err != nil {
+		t.Fatalf("Failed to read the lockfile: %v", err)
+	}
+	if locked.Find("plugin").Edges["react"] != locked.Find("react") {
+		t.Errorf("plugin should load react from the lockfile graph")
+	}
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Platform is what the os, cpu and libc fields of a package are checked
+// against, named the way Node.js names them: "linux", "darwin" or "win32",
+// "x64" or "arm64", "glibc" or "musl".
+type Platform struct {
+	OS   string
+	CPU  string
+	Libc string
+}
+
+// nodePlatforms and nodeArchs translate Go's names to Node.js's where they
+// differ.
+var (
+	nodePlatforms = map[string]string{"windows": "win32", "solaris": "sunos", "illumos": "sunos"}
+	nodeArchs     = map[string]string{"amd64": "x64", "386": "ia32", "ppc64le": "ppc64", "loong64": "loong64"}
+)
+
+// Platform is the platform packages are installed for: the host, unless
+// overridden by the os, cpu and libc settings, to install for another
+// machine.
+func (c *Config) Platform() Platform {
+	p := hostPlatform()
+	if os := c.Get("os"); os != "" {
+		p.OS = os
+	}
+	if cpu := c.Get("cpu"); cpu != "" {
+		p.CPU = cpu
+	}
+	if libc := c.Get("libc"); libc != "" {
+		p.Libc = libc
+	}
+	return p
+}
+
+func hostPlatform() Platform {
+	p := Platform{OS: runtime.GOOS, CPU: runtime.GOARCH}
+	if os, ok := nodePlatforms[p.OS]; ok {
+		p.OS = os
+	}
+	if cpu, ok := nodeArchs[p.CPU]; ok {
+		p.CPU = cpu
+	}
+	if p.OS == "linux" {
+		p.Libc = "glibc"
+		// musl distributions like Alpine ship their dynamic loader as
+		// ld-musl-<arch>.so.1
+		if matches, _ := filepath.Glob("/lib/ld-musl-*.so.1"); len(matches) > 0 {
+			p.Libc = "musl"
+		}
+	}
+	return p
+}
+
+// Supports reports whether a package with the given os, cpu and libc
+// fields can be installed on the platform. As in npm, each list allows
+// the values it names, rejects those prefixed with "!", and an empty list
+// allows everything. libc only applies to Linux.
+func (p Platform) Supports(os, cpu, libc []string) bool {
+	if !matchPlatformList(os, p.OS) || !matchPlatformList(cpu, p.CPU) {
+		return false
+	}
+	if len(libc) > 0 && p.OS != "linux" {
+		return false
+	}
+	return matchPlatformList(libc, p.Libc)
+}
+
+func matchPlatformList(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	allowed := false
+	hasAllowed := false
+	for _, entry := range list {
+		if name, ok := strings.CutPrefix(entry, "!"); ok {
+			if name == value {
+				return false
+			}
+			continue
+		}
+		hasAllowed = true
+		if entry == value || entry == "any" {
+			allowed = true
+		}
+	}
+	return allowed || !hasAllowed
+}
+
+// String formats the platform like "os=linux cpu=x64 libc=glibc".
+func (p Platform) String() string {
+	s := "os=" + p.OS + " cpu=" + p.CPU
+	if p.Libc != "" {
+		s += " libc=" + p.Libc
+	}
+	return s
+}
+
+// PlatformError is returned when a package the project requires does not
+// support the platform, like npm's EBADPLATFORM.
+type PlatformError struct {
+	Package  *Node
+	Platform Platform
+}
+
+func (e *PlatformError) Error() string {
+	var wanted []string
+	for _, field := range []struct {
+		name   string
+		values []string
+	}{{"os", e.Package.OS}, {"cpu", e.Package.CPU}, {"libc", e.Package.Libc}} {
+		if len(field.values) > 0 {
+			wanted = append(wanted, field.name+"="+strings.Join(field.values, ","))
+		}
+	}
+	return fmt.Sprintf("EBADPLATFORM: unsupported platform for %s: wanted %s (current: %s)",
+		e.Package, strings.Join(wanted, " "), e.Platform)
+}
+
+// supports reports whether node can be installed on the platform.
+func (p Platform) supports(node *Node) bool {
+	return p.Supports(node.OS, node.CPU, node.Libc)
+}
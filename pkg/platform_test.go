@@ -0,0 +1,305 @@
+package pkg_test
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestPlatformSupports(t *testing.T) {
+	linux := pkg.Platform{OS: "linux", CPU: "x64", Libc: "glibc"}
+	darwin := pkg.Platform{OS: "darwin", CPU: "arm64"}
+
+	tests := []struct {
+		name          string
+		platform      pkg.Platform
+		os, cpu, libc []string
+		want          bool
+	}{
+		{name: "no restrictions", platform: linux, want: true},
+		{name: "listed os", platform: linux, os: []string{"darwin", "linux"}, want: true},
+		{name: "unlisted os", platform: darwin, os: []string{"linux"}, want: false},
+		{name: "excluded os", platform: linux, os: []string{"!linux"}, want: false},
+		{name: "other os excluded", platform: darwin, os: []string{"!win32"}, want: true},
+		{name: "any cpu", platform: darwin, cpu: []string{"any"}, want: true},
+		{name: "unlisted cpu", platform: linux, cpu: []string{"arm64"}, want: false},
+		{name: "listed libc", platform: linux, libc: []string{"glibc"}, want: true},
+		{name: "unlisted libc", platform: linux, libc: []string{"musl"}, want: false},
+		{name: "libc outside Linux", platform: darwin, libc: []string{"glibc"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.platform.Supports(tt.os, tt.cpu, tt.libc); got != tt.want {
+				t.Errorf("Supports(%v, %v, %v) on %+v = %v, want %v", tt.os, tt.cpu, tt.libc, tt.platform, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlatformOverrides(t *testing.T) {
+	cfg := useTestConfig(t)
+	cfg.Set("os", "win32")
+	cfg.Set("cpu", "arm64")
+	if got := cfg.Platform(); got.OS != "win32" || got.CPU != "arm64" {
+		t.Errorf("Expected the os and cpu settings to override the host, got %+v", got)
+	}
+}
+
+// nativePackages is a package shipping its binaries as optional
+// dependencies, one per platform, like esbuild.
+func nativePackages() []registrytest.Package {
+	return []registrytest.Package{
+		{Name: "bundler", Version: "1.0.0", OptionalDependencies: map[string]string{
+			"bundler-linux-x64":    "1.0.0",
+			"bundler-linux-musl":   "1.0.0",
+			"bundler-darwin-arm64": "1.0.0",
+		}},
+		{Name: "bundler-linux-x64", Version: "1.0.0", OS: []string{"linux"}, CPU: []string{"x64"}, Libc: []string{"glibc"}},
+		{Name: "bundler-linux-musl", Version: "1.0.0", OS: []string{"linux"}, CPU: []string{"x64"}, Libc: []string{"musl"}},
+		{Name: "bundler-darwin-arm64", Version: "1.0.0", OS: []string{"darwin"}, CPU: []string{"arm64"}, Dependencies: map[string]string{"fsevents": "^2.0.0"}},
+		{Name: "fsevents", Version: "2.0.0"},
+	}
+}
+
+// installed lists the packages present in node_modules.
+func installed(t *testing.T, g *pkg.Graph) []string {
+	t.Helper()
+	var names []string
+	for _, node := range g.Nodes() {
+		if _, err := os.Stat(filepath.Join(node.Dir(), "package.json")); err == nil {
+			names = append(names, node.Path())
+		}
+	}
+	return names
+}
+
+func TestOptionalDependenciesForPlatform(t *testing.T) {
+	tests := []struct {
+		os, cpu, libc string
+		want          []string
+	}{
+		{os: "linux", cpu: "x64", libc: "glibc", want: []string{"bundler", "bundler-linux-x64"}},
+		{os: "linux", cpu: "x64", libc: "musl", want: []string{"bundler", "bundler-linux-musl"}},
+		{os: "darwin", cpu: "arm64", want: []string{"bundler", "bundler-darwin-arm64", "fsevents"}},
+		{os: "win32", cpu: "x64", want: []string{"bundler"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.os+"-"+tt.cpu+"-"+tt.libc, func(t *testing.T) {
+			reg := registrytest.New(t, nativePackages()...)
+			cfg := useTestConfig(t)
+			cfg.Set("registry", reg.URL)
+			cfg.Set("os", tt.os)
+			cfg.Set("cpu", tt.cpu)
+			cfg.Set("libc", tt.libc)
+			t.Chdir(t.TempDir())
+
+			registry := pkg.NewRegistry()
+			graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+				Dependencies: map[string]string{"bundler": "^1.0.0"},
+			})
+			if err != nil {
+				t.Fatalf("Failed to resolve: %v", err)
+			}
+			if err := pkg.Install(t.Context(), registry, graph, 4); err != nil {
+				t.Fatalf("Failed to install: %v", err)
+			}
+			if got := installed(t, graph); !slices.Equal(got, tt.want) {
+				t.Errorf("Installed %v, want %v", got, tt.want)
+			}
+			if len(graph.OptionalFailures) > 0 {
+				t.Errorf("Unsupported platforms should not be failures: %v", graph.OptionalFailures)
+			}
+
+			// Every variant stays in the lockfile, so it works on any
+			// platform
+			lockfile, _ := graph.Lock()
+			want := []string{"bundler", "bundler-darwin-arm64", "bundler-linux-musl", "bundler-linux-x64", "fsevents"}
+			if got := slices.Sorted(maps.Keys(lockfile)); !slices.Equal(got, want) {
+				t.Errorf("Lockfile has %v, want %v", got, want)
+			}
+			if dep := lockfile["bundler-darwin-arm64"]; !dep.Optional || !slices.Equal(dep.OS, []string{"darwin"}) {
+				t.Errorf("Expected an optional darwin entry, got %+v", dep)
+			}
+			if !lockfile["fsevents"].Optional || lockfile["bundler"].Optional {
+				t.Errorf("Only packages optional dependencies need should be optional")
+			}
+		})
+	}
+}
+
+func TestOptionalDependenciesFromLockfile(t *testing.T) {
+	reg := registrytest.New(t, nativePackages()...)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	cfg.Set("os", "linux")
+	cfg.Set("cpu", "x64")
+	cfg.Set("libc", "glibc")
+	t.Chdir(t.TempDir())
+
+	graph, err := (&pkg.Resolver{Registry: pkg.NewRegistry()}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"bundler": "^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	lockfile, devLock := graph.Lock()
+
+	// The lockfile made on Linux installs the darwin binary on a Mac
+	cfg.Set("os", "darwin")
+	cfg.Set("cpu", "arm64")
+	cfg.Set("libc", "")
+	locked, err := pkg.LockGraph(&pkg.PackageLock{Lockfile: lockfile, DevLock: devLock})
+	if err != nil {
+		t.Fatalf("Failed to read the lockfile: %v", err)
+	}
+	if err := pkg.Install(t.Context(), pkg.NewRegistry(), locked, 4); err != nil {
+		t.Fatalf("Failed to install: %v", err)
+	}
+	want := []string{"bundler", "bundler-darwin-arm64", "fsevents"}
+	if got := installed(t, locked); !slices.Equal(got, want) {
+		t.Errorf("Installed %v, want %v", got, want)
+	}
+}
+
+func TestOptionalDependencyFailures(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app", Version: "1.0.0", OptionalDependencies: map[string]string{
+			"broken":  "^1.0.0",
+			"missing": "^1.0.0",
+			"nothing": "^2.0.0",
+		}},
+		registrytest.Package{Name: "broken", Version: "1.0.0", Dependencies: map[string]string{"broken-dep": "^1.0.0"}},
+		registrytest.Package{Name: "broken-dep", Version: "1.0.0"},
+		registrytest.Package{Name: "nothing", Version: "1.0.0"},
+	)
+	reg.FailNext(registrytest.TarballPath("broken", "1.0.0"), http.StatusNotFound)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"app": "^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if err := pkg.Install(t.Context(), registry, graph, 4); err != nil {
+		t.Fatalf("Optional failures should not fail the install: %v", err)
+	}
+
+	if got := installed(t, graph); !slices.Equal(got, []string{"app"}) {
+		t.Errorf("Installed %v, want only app", got)
+	}
+	var failures []string
+	for _, err := range graph.OptionalFailures {
+		failures = append(failures, err.Error())
+	}
+	slices.Sort(failures)
+	if len(failures) != 3 ||
+		!strings.HasPrefix(failures[0], "broken@1.0.0: ") ||
+		!strings.HasPrefix(failures[1], "missing, optional dependency of app@1.0.0: ") ||
+		!strings.HasPrefix(failures[2], "nothing, optional dependency of app@1.0.0: ") {
+		t.Errorf("Unexpected failures:\n%s", strings.Join(failures, "\n"))
+	}
+}
+
+func TestRequiredDependencyFailureStillFails(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app", Version: "1.0.0", Dependencies: map[string]string{"broken": "^1.0.0"}},
+		registrytest.Package{Name: "broken", Version: "1.0.0"},
+	)
+	reg.FailNext(registrytest.TarballPath("broken", "1.0.0"), http.StatusNotFound)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"app": "^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if err := pkg.Install(t.Context(), registry, graph, 4); err == nil {
+		t.Errorf("Expected a required package failing to fail the install")
+	}
+}
+
+func TestOptionalDependencyWithFailingDependency(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app", Version: "1.0.0"},
+		registrytest.Package{Name: "opt", Version: "1.0.0", Dependencies: map[string]string{"gone": "^1.0.0", "helper": "^1.0.0"}},
+		registrytest.Package{Name: "watcher", Version: "1.0.0", Dependencies: map[string]string{"native": "^1.0.0"}},
+		registrytest.Package{Name: "native", Version: "1.0.0"},
+		registrytest.Package{Name: "helper", Version: "1.0.0"},
+	)
+	reg.FailNext(registrytest.TarballPath("native", "1.0.0"), http.StatusNotFound)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies:         map[string]string{"app": "^1.0.0"},
+		OptionalDependencies: map[string]string{"opt": "^1.0.0", "watcher": "^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("A dependency of an optional package failing should not fail: %v", err)
+	}
+	// opt cannot work without gone, so it goes, and helper with it
+	want := map[string]string{"app": "1.0.0", "native": "1.0.0", "watcher": "1.0.0"}
+	if got := treeVersions(graph); !maps.Equal(got, want) {
+		t.Errorf("Unexpected tree:\n got %v\nwant %v", got, want)
+	}
+	if len(graph.OptionalFailures) != 1 || !strings.HasPrefix(graph.OptionalFailures[0].Error(), "gone, required by opt@1.0.0: ") {
+		t.Errorf("Unexpected failures: %v", graph.OptionalFailures)
+	}
+
+	// watcher cannot work without native, which fails to download
+	if err := pkg.Install(t.Context(), registry, graph, 4); err != nil {
+		t.Fatalf("Failed to install: %v", err)
+	}
+	if got := installed(t, graph); !slices.Equal(got, []string{"app"}) {
+		t.Errorf("Installed %v, want only app", got)
+	}
+}
+
+func TestRequiredPackageForOtherPlatformFails(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app", Version: "1.0.0", Dependencies: map[string]string{"fsevents": "^2.0.0"}},
+		registrytest.Package{Name: "fsevents", Version: "2.0.0", OS: []string{"darwin"}},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	cfg.Set("os", "linux")
+	cfg.Set("cpu", "x64")
+	t.Chdir(t.TempDir())
+
+	registry := pkg.NewRegistry()
+	graph, err := (&pkg.Resolver{Registry: registry}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies: map[string]string{"app": "^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	err = pkg.Install(t.Context(), registry, graph, 4)
+	var platformErr *pkg.PlatformError
+	if !errors.As(err, &platformErr) || platformErr.Package.Name != "fsevents" {
+		t.Fatalf("Expected a PlatformError for fsevents, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "wanted os=darwin (current: os=linux cpu=x64") {
+		t.Errorf("Unexpected message: %v", err)
+	}
+	if got := installed(t, graph); len(got) > 0 {
+		t.Errorf("Nothing should be installed, got %v", got)
+	}
+}
@@ -0,0 +1,36 @@
+package pkg
+
+import "context"
+
+// Registry is where package metadata and tarballs come from. Installing
+// only talks to the network through it. Cancelling ctx aborts a request,
+// including its retries.
+type Registry interface {
+	// Packument returns the metadata needed to resolve and install name.
+	Packument(ctx context.Context, name string) (*Packument, error)
+	// FullPackument returns the complete registry document of name.
+	FullPackument(ctx context.Context, name string) (*FullPackument, error)
+	// Tarball downloads the tarball at url and extracts it into dest,
+	// verifying it against integrity when that is set.
+	Tarball(ctx context.Context, url, dest, integrity string) error
+}
+
+// HTTPRegistry is the Registry of the configured npm registries, reached
+// over HTTP through the metadata cache.
+type HTTPRegistry struct{}
+
+func NewRegistry() Registry {
+	return &HTTPRegistry{}
+}
+
+func (r *HTTPRegistry) Packument(ctx context.Context, name string) (*Packument, error) {
+	return fetchPackageMeta(ctx, name)
+}
+
+func (r *HTTPRegistry) FullPackument(ctx context.Context, name string) (*FullPackument, error) {
+	return fetchFullPackageMeta(ctx, name)
+}
+
+func (r *HTTPRegistry) Tarball(ctx context.Context, url, dest, integrity string) error {
+	return downloadAndExtractTarball(ctx, url, dest, integrity)
+}
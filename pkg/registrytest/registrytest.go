@@ -0,0 +1,252 @@
+// Package registrytest provides a fake npm registry for tests. It serves
+// packuments and generated tarballs for packages described in memory, so
+// tests never depend on the real registry.
+package registrytest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Package describes one published version. A package.json is generated
+// from Name, Version and the dependencies unless Files provides one.
+type Package struct {
+	Name                 string
+	Version              string
+	Dependencies         map[string]string
+	OptionalDependencies map[string]string
+	PeerDependencies     map[string]string
+	// OptionalPeers are the peer dependencies marked optional
+	OptionalPeers []string
+	// OS, CPU and Libc restrict the platforms the package installs on
+	OS, CPU, Libc []string
+	// BundleDependencies are the dependencies the tarball ships, which
+	// Files should provide under node_modules
+	BundleDependencies []string
+	Files              map[string]string
+}
+
+// Dep returns a Package depending on deps, given as name and range pairs.
+func Dep(name, version string, deps ...string) Package {
+	p := Package{Name: name, Version: version, Dependencies: map[string]string{}}
+	for i := 0; i < len(deps); i += 2 {
+		p.Dependencies[deps[i]] = deps[i+1]
+	}
+	return p
+}
+
+// Registry is an httptest server acting as an npm registry.
+type Registry struct {
+	URL string
+
+	server   *httptest.Server
+	mu       sync.Mutex
+	packages map[string][]Package
+	tags     map[string]map[string]string
+	tarballs map[string][]byte
+	failures map[string][]int
+	requests map[string]int
+}
+
+// New starts a registry serving pkgs. It is closed when the test ends.
+func New(t testing.TB, pkgs ...Package) *Registry {
+	t.Helper()
+	r := &Registry{
+		packages: make(map[string][]Package),
+		tags:     make(map[string]map[string]string),
+		tarballs: make(map[string][]byte),
+		failures: make(map[string][]int),
+		requests: make(map[string]int),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	r.URL = r.server.URL + "/"
+	t.Cleanup(r.server.Close)
+	r.Add(pkgs...)
+	return r
+}
+
+// Add publishes more versions. The last version added for a package becomes
+// its latest dist-tag.
+func (r *Registry) Add(pkgs ...Package) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range pkgs {
+		r.packages[p.Name] = append(r.packages[p.Name], p)
+		if r.tags[p.Name] == nil {
+			r.tags[p.Name] = make(map[string]string)
+		}
+		r.tags[p.Name]["latest"] = p.Version
+		r.tarballs[TarballPath(p.Name, p.Version)] = Tarball(p.files())
+	}
+}
+
+// Tag points a dist-tag of name at version.
+func (r *Registry) Tag(name, tag, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tags[name] == nil {
+		r.tags[name] = make(map[string]string)
+	}
+	r.tags[name][tag] = version
+}
+
+// FailNext makes the next requests for path fail with the given statuses,
+// one per request, before it is served normally again.
+func (r *Registry) FailNext(path string, statuses ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures[path] = append(r.failures[path], statuses...)
+}
+
+// TarballURL returns where the tarball of name@version is served.
+func (r *Registry) TarballURL(name, version string) string {
+	return r.server.URL + TarballPath(name, version)
+}
+
+// TarballPath is the path of the tarball of name@version on the server,
+// mirroring the registry layout /name/-/basename-version.tgz.
+func TarballPath(name, version string) string {
+	base := name[strings.LastIndex(name, "/")+1:]
+	return fmt.Sprintf("/%s/-/%s-%s.tgz", name, base, version)
+}
+
+// Requests returns how many times path, such as "/lodash" or a tarball
+// path, was requested.
+func (r *Registry) Requests(path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests[path]
+}
+
+// Close shuts the server down, making every later request fail.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[req.URL.Path]++
+
+	if failures := r.failures[req.URL.Path]; len(failures) > 0 {
+		r.failures[req.URL.Path] = failures[1:]
+		http.Error(w, http.StatusText(failures[0]), failures[0])
+		return
+	}
+
+	if tarball, ok := r.tarballs[req.URL.Path]; ok {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(tarball)
+		return
+	}
+
+	name, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/"))
+	if err != nil || len(r.packages[name]) == 0 {
+		http.Error(w, `{"error":"Not found"}`, http.StatusNotFound)
+		return
+	}
+
+	versions := make(map[string]interface{})
+	for _, p := range r.packages[name] {
+		tarball := r.tarballs[TarballPath(p.Name, p.Version)]
+		manifest := p.manifest()
+		manifest["dist"] = map[string]string{
+			"tarball":   r.server.URL + TarballPath(p.Name, p.Version),
+			"integrity": Integrity(tarball),
+		}
+		versions[p.Version] = manifest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":      name,
+		"dist-tags": r.tags[name],
+		"versions":  versions,
+	})
+}
+
+func (p Package) files() map[string]string {
+	files := make(map[string]string, len(p.Files)+1)
+	for name, content := range p.Files {
+		files[name] = content
+	}
+	if _, ok := files["package.json"]; !ok {
+		manifest, _ := json.Marshal(p.manifest())
+		files["package.json"] = string(manifest)
+	}
+	return files
+}
+
+// manifest is the package.json of the package, as in its packument.
+func (p Package) manifest() map[string]interface{} {
+	manifest := map[string]interface{}{
+		"name":         p.Name,
+		"version":      p.Version,
+		"dependencies": p.Dependencies,
+	}
+	if len(p.OptionalDependencies) > 0 {
+		manifest["optionalDependencies"] = p.OptionalDependencies
+	}
+	if len(p.PeerDependencies) > 0 {
+		manifest["peerDependencies"] = p.PeerDependencies
+	}
+	for field, values := range map[string][]string{"os": p.OS, "cpu": p.CPU, "libc": p.Libc} {
+		if len(values) > 0 {
+			manifest[field] = values
+		}
+	}
+	if len(p.BundleDependencies) > 0 {
+		manifest["bundleDependencies"] = p.BundleDependencies
+	}
+	if len(p.OptionalPeers) > 0 {
+		meta := make(map[string]interface{})
+		for _, name := range p.OptionalPeers {
+			meta[name] = map[string]bool{"optional": true}
+		}
+		manifest["peerDependenciesMeta"] = meta
+	}
+	return manifest
+}
+
+// Tarball builds a gzipped package tarball holding files under the usual
+// "package/" directory. Entries are sorted so equal inputs give equal bytes.
+func Tarball(files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{
+			Name:     "package/" + name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+		})
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gzw.Close()
+	return buf.Bytes()
+}
+
+// Integrity returns the sha512 SRI string of data.
+func Integrity(data []byte) string {
+	sum := sha512.Sum512(data)
+	return "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+}
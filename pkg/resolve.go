@@ -0,0 +1,428 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Resolver builds the dependency graph of a project. Versions recorded in
+// Lock are kept as long as they still satisfy what is asked for, and
+// everything else is resolved against Registry, fetching the metadata of
+// up to Workers packages at once.
+type Resolver struct {
+	Registry Registry
+	Lock     *PackageLock
+	Workers  int
+}
+
+// Resolve plans the node_modules tree of a project, keeping the versions
+// in Lock that still fit. Failed optional dependencies, peer conflicts and
+// unmet dependencies are reported in the graph. It fails on a required
+// package that cannot be resolved, on peer conflicts in strict mode or when
+// ctx is cancelled, and in offline mode returns the graph with an OfflineError.
+func (r *Resolver) Resolve(ctx context.Context, pkgJSON *PackageJSON) (*Graph, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	g := &Graph{Root: newNode(pkgJSON.Name, pkgJSON.Version)}
+	// devDependencies first, so dependencies win for a name in both
+	g.Root.Dependencies = make(map[string]string)
+	for name, spec := range pkgJSON.DevDependencies {
+		g.Root.Dependencies[name] = spec
+	}
+	for name, spec := range pkgJSON.Dependencies {
+		g.Root.Dependencies[name] = spec
+	}
+	g.Root.OptionalDependencies = pkgJSON.OptionalDependencies
+
+	workers := r.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	res := &resolution{
+		locked:   make(map[string]LockedDependency),
+		peerMode: Cfg.PeerDepsMode(),
+		packuments: &packumentLoader{
+			ctx:   ctx,
+			reg:   r.Registry,
+			sem:   make(chan struct{}, workers),
+			calls: make(map[string]*packumentCall),
+		},
+	}
+	// Locked versions are kept as long as they satisfy what is asked for
+	if r.Lock != nil {
+		for path, dep := range r.Lock.DevLock {
+			res.locked[path] = dep
+		}
+		for path, dep := range r.Lock.Lockfile {
+			res.locked[path] = dep
+		}
+	}
+
+	// Abandon prefetches nothing ended up needing, cancelling before
+	// waiting so none runs out its retries
+	defer func() {
+		cancel()
+		res.packuments.wait()
+	}()
+
+	// In offline mode packages missing from the caches are left out and
+	// reported together, instead of stopping at the first one
+	missing := &OfflineError{}
+	// Only this goroutine touches the graph, so the result does not depend
+	// on timing. Packuments a new package may need start loading in the
+	// background as soon as it is added, and the walk waits for those it uses.
+	res.prefetch(g.Root)
+	// Breadth first, walking only packages just added, so a cycle stops when
+	// it comes back to a package in place. cycleTo stops those that never
+	// would, leaving an unmet dependency.
+	queue := []*Node{g.Root}
+	follow := func(node *Node, name string, dep *Node, added bool) {
+		if dep == nil {
+			return
+		}
+		node.Edges[name] = dep
+		if added {
+			res.prefetch(dep)
+			queue = append(queue, dep)
+		}
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, name := range sortedKeys(node.Dependencies) {
+			if _, ok := node.OptionalDependencies[name]; ok {
+				// As in npm, optionalDependencies override dependencies
+				continue
+			}
+			dep, added, err := res.resolveDependency(node, name, node.Dependencies[name])
+			if !missing.add(err) {
+				res.fail(node, fmt.Errorf("%s, required by %s: %w", name, node, err))
+				continue
+			}
+			follow(node, name, dep, added)
+		}
+		// Optional dependencies that cannot be resolved are only reported.
+		// Those for other platforms are kept for the lockfile to work
+		// everywhere, and skipped when installing.
+		for _, name := range sortedKeys(node.OptionalDependencies) {
+			dep, added, err := res.resolveDependency(node, name, node.OptionalDependencies[name])
+			if err != nil {
+				res.optionalFailures = append(res.optionalFailures, fmt.Errorf("%s, optional dependency of %s: %w", name, node, err))
+				continue
+			}
+			follow(node, name, dep, added)
+		}
+
+		if res.peerMode == PeerDepsLegacy {
+			continue
+		}
+		// Peers come after the dependencies of the package depending on
+		// node, which were resolved when it was walked
+		for _, name := range sortedKeys(node.PeerDependencies) {
+			dep, added, err := res.resolvePeer(node, name, node.PeerDependencies[name])
+			if !missing.add(err) {
+				res.fail(node, fmt.Errorf("%s, peer of %s: %w", name, node, err))
+				continue
+			}
+			follow(node, name, dep, added)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Whether a failure is fatal depends on whether the package failing is
+	// only needed through optional dependencies, which is only known once
+	// the whole graph is resolved
+	g.markOptional()
+	var broken []*Node
+	for _, f := range res.failures {
+		if !f.node.Optional {
+			return nil, f.err
+		}
+		broken = append(broken, f.node)
+		res.optionalFailures = append(res.optionalFailures, f.err)
+	}
+	g.prune(g.brokenBy(broken))
+
+	prod := append(sortedKeys(pkgJSON.Dependencies), sortedKeys(pkgJSON.OptionalDependencies)...)
+	g.markDev(prod)
+	g.markOptional()
+	g.PeerConflicts = res.peerConflicts
+	g.UnmetDependencies = res.unmet
+	g.OptionalFailures = res.optionalFailures
+	if len(g.PeerConflicts) > 0 && res.peerMode == PeerDepsStrict {
+		return nil, &PeerConflictError{Conflicts: g.PeerConflicts}
+	}
+	if len(missing.Missing) > 0 {
+		return g, missing
+	}
+	return g, nil
+}
+
+// resolution is the state of one Resolve call.
+type resolution struct {
+	locked        map[string]LockedDependency
+	packuments    *packumentLoader
+	peerMode      string
+	peerConflicts []PeerConflict
+	unmet         []UnmetDependency
+
+	optionalFailures []error
+	// failures are the packages with a dependency that could not be
+	// resolved, fatal unless they are optional
+	failures []resolveFailure
+}
+
+type resolveFailure struct {
+	node *Node
+	err  error
+}
+
+func (res *resolution) fail(node *Node, err error) {
+	res.failures = append(res.failures, resolveFailure{node: node, err: err})
+}
+
+// prefetch starts loading the packuments the dependencies of a new node
+// will need, unless the lockfile already settles them.
+func (res *resolution) prefetch(node *Node) {
+	for _, name := range sortedKeys(node.Dependencies) {
+		res.prefetchDependency(node, name, node.Dependencies[name])
+	}
+	for _, name := range sortedKeys(node.OptionalDependencies) {
+		res.prefetchDependency(node, name, node.OptionalDependencies[name])
+	}
+	if res.peerMode == PeerDepsLegacy || node.Parent == nil {
+		return
+	}
+	for _, name := range sortedKeys(node.PeerDependencies) {
+		if !node.PeerDependenciesMeta[name].Optional {
+			res.prefetchDependency(node.Parent, name, node.PeerDependencies[name])
+		}
+	}
+}
+
+func (res *resolution) prefetchDependency(from *Node, name, rawSpec string) {
+	if dep := from.Lookup(name); dep != nil && dep.InBundle {
+		return
+	}
+	spec, err := ResolvePackageSpec(name, rawSpec)
+	if err != nil {
+		return
+	}
+	if res.lockedVersion(from, name, spec.Target()) == nil {
+		res.packuments.start(spec.Target().Name)
+	}
+}
+
+// resolveDependency finds or adds the node that from's dependency on name
+// resolves to, reporting whether it was added.
+func (res *resolution) resolveDependency(from *Node, name, rawSpec string) (*Node, bool, error) {
+	spec, err := ResolvePackageSpec(name, rawSpec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Reuse the version Node.js would find from the dependent when it fits.
+	// Bundled packages are taken as they come in their dependent's tarball.
+	existing := from.Lookup(name)
+	if existing != nil && (existing.InBundle || existing.matches(spec)) {
+		return existing, false, nil
+	}
+
+	node, err := res.pickVersion(from, name, spec.Target())
+	if err != nil {
+		return nil, false, err
+	}
+	if existing != nil && existing.same(node) {
+		return existing, false, nil
+	}
+	if cycleTo(from, node) != nil {
+		res.unmet = append(res.unmet, UnmetDependency{Dependent: from, Name: name, Range: rawSpec, Found: existing})
+		return existing, false, nil
+	}
+	placeNode(from, node).addChild(node)
+	return node, true, nil
+}
+
+// cycleTo returns the package above from, from included, that is the same
+// version of the same package as node. Node.js would load it if no other
+// version of the package was closer, so there always is one, and the
+// dependency can only be met by nesting node. In a dependency cycle running
+// through conflicting versions, like a@1 -> b@1 -> a@2 -> b@2 -> a@1, that
+// would nest a new copy of the whole cycle inside the last one forever, so
+// the dependency is left on the closer version instead.
+func cycleTo(from *Node, node *Node) *Node {
+	for dir := from; dir.Parent != nil; dir = dir.Parent {
+		if dir.Name == node.Name && dir.same(node) {
+			return dir
+		}
+	}
+	return nil
+}
+
+// pickVersion returns a new node, to install as name, for the version of
+// the package spec asks for: the one in the lockfile where Node.js would
+// find it from from, if it satisfies spec, and otherwise the best match in
+// the registry. For an alias, spec is the target of the alias.
+func (res *resolution) pickVersion(from *Node, name string, spec *PackageSpec) (*Node, error) {
+	if node := res.lockedVersion(from, name, spec); node != nil {
+		return node, nil
+	}
+
+	meta, err := res.packuments.load(spec.Name)
+	if err != nil {
+		return nil, offlineMiss(err, spec.Name, spec.FetchSpec)
+	}
+	version, err := ResolveVersion(meta, spec.FetchSpec)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", spec, err)
+	}
+	manifest, err := meta.Manifest(version)
+	if err != nil {
+		return nil, err
+	}
+	tarballURL, err := GetTarballURL(meta, version)
+	if err != nil {
+		return nil, err
+	}
+	integrity, err := GetTarballIntegrity(meta, version)
+	if err != nil {
+		return nil, err
+	}
+
+	node := nodeFromManifest(name, version, manifest)
+	if spec.Name != name {
+		node.PackageName = spec.Name
+	}
+	node.Resolved = tarballURL
+	node.Integrity = integrity
+	return node, nil
+}
+
+// lockedVersion returns a new node for the package installed as name the
+// lockfile has where Node.js would find it from from, or nil if there is
+// none or it is not the package and version spec asks for.
+func (res *resolution) lockedVersion(from *Node, name string, spec *PackageSpec) *Node {
+	for dir := from; dir != nil; dir = dir.Parent {
+		dep, ok := res.locked[childPath(dir.Path(), name)]
+		if !ok {
+			continue
+		}
+		node := nodeFromLock(name, dep)
+		// Entries from before requires was recorded need the manifest
+		if node.registryName() != spec.Name || !satisfies(dep.Version, spec.FetchSpec) || dep.Resolved == "" || dep.Requires == nil {
+			return nil
+		}
+		return node
+	}
+	return nil
+}
+
+// packumentLoader fetches packuments in the background, at most cap(sem)
+// at once and each package once, however many times it is asked for. Only
+// the resolving goroutine calls it, the fetches hand their result over
+// through the call's done channel.
+type packumentLoader struct {
+	ctx     context.Context
+	reg     Registry
+	sem     chan struct{}
+	calls   map[string]*packumentCall
+	pending sync.WaitGroup
+}
+
+type packumentCall struct {
+	done chan struct{}
+	meta *Packument
+	err  error
+}
+
+// start begins fetching the packument of name, unless it already was.
+func (l *packumentLoader) start(name string) *packumentCall {
+	if call, ok := l.calls[name]; ok {
+		return call
+	}
+	call := &packumentCall{done: make(chan struct{})}
+	l.calls[name] = call
+	l.pending.Add(1)
+	go func() {
+		defer l.pending.Done()
+		defer close(call.done)
+		select {
+		case l.sem <- struct{}{}:
+			defer func() { <-l.sem }()
+			call.meta, call.err = l.reg.Packument(l.ctx, name)
+		case <-l.ctx.Done():
+			call.err = l.ctx.Err()
+		}
+	}()
+	return call
+}
+
+// wait blocks until every fetch started has finished, so none outlives the
+// resolution, even a cancelled one.
+func (l *packumentLoader) wait() {
+	l.pending.Wait()
+}
+
+// load waits for the packument of name, starting to fetch it if needed.
+func (l *packumentLoader) load(name string) (*Packument, error) {
+	call := l.start(name)
+	select {
+	case <-call.done:
+		return call.meta, call.err
+	case <-l.ctx.Done():
+		return nil, l.ctx.Err()
+	}
+}
+
+// placeNode decides which node_modules a new package needed by from goes
+// in, hoisting it as high as it can go the way npm does. Starting at from,
+// it moves up one level at a time and stops below the first node_modules
+// already holding another version of the package, or at the first level
+// where packages already relying on a version further up would load the
+// new one instead without it satisfying them. As packages are resolved in a
+// fixed order, the same graph always gets the same placement.
+func placeNode(from *Node, node *Node) *Node {
+	target := from
+	for dir := from.Parent; dir != nil; dir = dir.Parent {
+		if dir.Children[node.Name] != nil || shadows(dir, node) {
+			break
+		}
+		target = dir
+	}
+	return target
+}
+
+// shadows reports whether placing node in dir's node_modules would change
+// what a package below dir loads for node's name to a version it does not
+// accept.
+func shadows(dir *Node, node *Node) bool {
+	for _, child := range dir.Children {
+		if shadowsFrom(child, node) {
+			return true
+		}
+	}
+	return false
+}
+
+func shadowsFrom(n *Node, node *Node) bool {
+	// A package with its own copy keeps loading it, as does everything
+	// below it
+	if n.Children[node.Name] != nil {
+		return false
+	}
+	if _, ok := n.Edges[node.Name]; ok {
+		spec, err := ResolvePackageSpec(node.Name, n.dependencySpec(node.Name))
+		if err != nil || !node.matches(spec) {
+			return true
+		}
+	}
+	for _, child := range n.Children {
+		if shadowsFrom(child, node) {
+			return true
+		}
+	}
+	return false
+}
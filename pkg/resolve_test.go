@@ -0,0 +1,652 @@
+package pkg_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+// treeVersions maps each package of a graph's lockfile to its version.
+func treeVersions(g *pkg.Graph) map[string]string {
+	prod, dev := g.Lock()
+	versions := make(map[string]string)
+	for path, dep := range prod {
+		versions[path] = dep.Version
+	}
+	for path, dep := range dev {
+		versions[path] = dep.Version
+	}
+	return versions
+}
+
+func TestResolveDoesNotTouchDisk(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-lib", Version: "1.0.0", Dependencies: map[string]string{"helper": "^1.0.0"}},
+		registrytest.Package{Name: "helper", Version: "1.0.0"},
+		registrytest.Package{Name: "helper", Version: "1.2.0"},
+		registrytest.Package{Name: "helper", Version: "2.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	graph, err := (&pkg.Resolver{Registry: pkg.NewRegistry()}).Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies:    map[string]string{"app-lib": "^1.0.0"},
+		DevDependencies: map[string]string{"helper": "2.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	want := map[string]string{
+		"app-lib":                     "1.0.0",
+		"helper":                      "2.0.0",
+		"app-lib/node_modules/helper": "1.2.0",
+	}
+	if got := treeVersions(graph); !maps.Equal(got, want) {
+		t.Errorf("Unexpected tree:\n got %v\nwant %v", got, want)
+	}
+
+	appLib := graph.Find("app-lib")
+	if helper := appLib.Edges["helper"]; helper != graph.Find("app-lib/node_modules/helper") {
+		t.Errorf("app-lib should load its nested helper, got %v", helper)
+	}
+	if !graph.Find("helper").Dev || appLib.Dev {
+		t.Errorf("Only the top helper should be a dev dependency")
+	}
+
+	if _, err := os.Stat("node_modules"); !os.IsNotExist(err) {
+		t.Errorf("Resolving should not create node_modules: %v", err)
+	}
+	if n := reg.Requests(registrytest.TarballPath("app-lib", "1.0.0")); n != 0 {
+		t.Errorf("Resolving should not download tarballs, got %d requests", n)
+	}
+}
+
+func TestResolveKeepsLockedVersions(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-lib", Version: "1.0.0", Dependencies: map[string]string{"helper": "^1.0.0"}},
+		registrytest.Package{Name: "helper", Version: "1.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	pkgJSON := &pkg.PackageJSON{Dependencies: map[string]string{"app-lib": "^1.0.0"}}
+	resolver := &pkg.Resolver{Registry: pkg.NewRegistry()}
+	graph, err := resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	lockfile, devLock := graph.Lock()
+
+	// A newer helper must not replace the locked one, and nothing needs
+	// to be asked of the registry
+	reg.Add(registrytest.Package{Name: "helper", Version: "1.1.0"})
+	pkg.ResetMetadataMemo()
+	before := reg.Requests("/app-lib") + reg.Requests("/helper")
+	resolver.Lock = &pkg.PackageLock{Lockfile: lockfile, DevLock: devLock}
+	graph, err = resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve with the lockfile: %v", err)
+	}
+	if got := graph.Find("helper").Version; got != "1.0.0" {
+		t.Errorf("Expected the locked helper@1.0.0, got %s", got)
+	}
+	if after := reg.Requests("/app-lib") + reg.Requests("/helper"); after != before {
+		t.Errorf("Expected no metadata requests with a lockfile, got %d", after-before)
+	}
+
+	// A range the locked version no longer satisfies is resolved again
+	pkgJSON.Dependencies["helper"] = "^1.1.0"
+	graph, err = resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if got := graph.Find("helper").Version; got != "1.1.0" {
+		t.Errorf("Expected helper@1.1.0, got %s", got)
+	}
+}
+
+func TestLockGraph(t *testing.T) {
+	lock := &pkg.PackageLock{
+		Lockfile: map[string]pkg.LockedDependency{
+			"app-lib":                     {Version: "1.0.0", Requires: map[string]string{"helper": "^1.0.0", "util": "^1.0.0"}},
+			"app-lib/node_modules/helper": {Version: "1.2.0", Requires: map[string]string{}},
+			"util":                        {Version: "1.0.0", Requires: map[string]string{}},
+		},
+		DevLock: map[string]pkg.LockedDependency{
+			"helper": {Version: "2.0.0", Requires: map[string]string{}},
+		},
+	}
+
+	graph, err := pkg.LockGraph(lock)
+	if err != nil {
+		t.Fatalf("Failed to read the lockfile: %v", err)
+	}
+	appLib := graph.Find("app-lib")
+	if appLib.Edges["helper"] != graph.Find("app-lib/node_modules/helper") {
+		t.Errorf("app-lib should load its nested helper")
+	}
+	if appLib.Edges["util"] != graph.Find("util") {
+		t.Errorf("app-lib should load the top util")
+	}
+	if !graph.Find("helper").Dev || appLib.Dev {
+		t.Errorf("Only the top helper should be a dev dependency")
+	}
+
+	lockfile, devLock := graph.Lock()
+	if !maps.EqualFunc(lockfile, lock.Lockfile, sameEntry) || !maps.EqualFunc(devLock, lock.DevLock, sameEntry) {
+		t.Errorf("Lockfile changed in the round trip:\n got %v %v\nwant %v %v", lockfile, devLock, lock.Lockfile, lock.DevLock)
+	}
+
+	delete(lock.Lockfile, "app-lib")
+	if _, err := pkg.LockGraph(lock); err == nil {
+		t.Errorf("Expected an error for a package nested in a missing one")
+	}
+}
+
+func sameEntry(a, b pkg.LockedDependency) bool {
+	return a.Version == b.Version && a.Resolved == b.Resolved && a.Integrity == b.Integrity && maps.Equal(a.Requires, b.Requires)
+}
+
+func TestHoisting(t *testing.T) {
+	tests := []struct {
+		name     string
+		packages []registrytest.Package
+		direct   map[string]string
+		want     map[string]string
+	}{
+		{
+			name: "shared dependency is deduplicated at the top",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "c", "^1.0.0"),
+				registrytest.Dep("b", "1.0.0", "c", "^1.1.0"),
+				registrytest.Dep("c", "1.0.0"),
+				registrytest.Dep("c", "1.2.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "b": "^1.0.0"},
+			want:   map[string]string{"a": "1.0.0", "b": "1.0.0", "c": "1.2.0"},
+		},
+		{
+			name: "transitive dependencies are flattened",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "b", "^1.0.0"),
+				registrytest.Dep("b", "1.0.0", "c", "^1.0.0"),
+				registrytest.Dep("c", "1.0.0", "d", "^1.0.0"),
+				registrytest.Dep("d", "1.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0"},
+			want:   map[string]string{"a": "1.0.0", "b": "1.0.0", "c": "1.0.0", "d": "1.0.0"},
+		},
+		{
+			name: "direct dependency keeps the top over a transitive one",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "shared", "^1.0.0"),
+				registrytest.Dep("shared", "1.0.0"),
+				registrytest.Dep("shared", "2.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "shared": "^2.0.0"},
+			want:   map[string]string{"a": "1.0.0", "shared": "2.0.0", "a/node_modules/shared": "1.0.0"},
+		},
+		{
+			name: "conflict at the top is hoisted to the highest free level",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "x", "^1.0.0"),
+				registrytest.Dep("x", "1.0.0", "shared", "^1.0.0"),
+				registrytest.Dep("x", "2.0.0"),
+				registrytest.Dep("shared", "1.0.0"),
+				registrytest.Dep("shared", "2.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "shared": "^2.0.0", "x": "^2.0.0"},
+			want: map[string]string{
+				"a": "1.0.0", "shared": "2.0.0", "x": "2.0.0",
+				"a/node_modules/x":      "1.0.0",
+				"a/node_modules/shared": "1.0.0",
+			},
+		},
+		{
+			name: "hoisting stops where it would shadow another dependent",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "m", "^1.0.0", "x", "^1.0.0"),
+				registrytest.Dep("m", "1.0.0", "shared", "^1.0.0"),
+				registrytest.Dep("m", "2.0.0"),
+				registrytest.Dep("x", "1.0.0", "shared", "^2.0.0"),
+				registrytest.Dep("x", "2.0.0"),
+				registrytest.Dep("shared", "1.0.0"),
+				registrytest.Dep("shared", "2.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "m": "^2.0.0", "shared": "^1.0.0", "x": "^2.0.0"},
+			want: map[string]string{
+				"a": "1.0.0", "m": "2.0.0", "shared": "1.0.0", "x": "2.0.0",
+				"a/node_modules/m":                     "1.0.0",
+				"a/node_modules/x":                     "1.0.0",
+				"a/node_modules/x/node_modules/shared": "2.0.0",
+			},
+		},
+		{
+			name: "same conflicting version is duplicated in separate branches",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "shared", "^1.0.0"),
+				registrytest.Dep("b", "1.0.0", "shared", "^1.0.0"),
+				registrytest.Dep("shared", "1.0.0"),
+				registrytest.Dep("shared", "2.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "b": "^1.0.0", "shared": "^2.0.0"},
+			want: map[string]string{
+				"a": "1.0.0", "b": "1.0.0", "shared": "2.0.0",
+				"a/node_modules/shared": "1.0.0",
+				"b/node_modules/shared": "1.0.0",
+			},
+		},
+		{
+			name: "nested package reuses a compatible copy above it",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "shared", "^1.0.0", "y", "^1.0.0"),
+				registrytest.Dep("y", "1.0.0", "shared", "^1.0.0"),
+				registrytest.Dep("y", "2.0.0"),
+				registrytest.Dep("shared", "1.0.0"),
+				registrytest.Dep("shared", "2.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "shared": "^2.0.0", "y": "^2.0.0"},
+			want: map[string]string{
+				"a": "1.0.0", "shared": "2.0.0", "y": "2.0.0",
+				"a/node_modules/shared": "1.0.0",
+				"a/node_modules/y":      "1.0.0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registrytest.New(t, tt.packages...)
+			cfg := useTestConfig(t)
+			cfg.Set("registry", reg.URL)
+
+			var first []string
+			for range 2 {
+				graph, err := (&pkg.Resolver{Registry: pkg.NewRegistry()}).Resolve(t.Context(), &pkg.PackageJSON{Dependencies: tt.direct})
+				if err != nil {
+					t.Fatalf("Failed to resolve: %v", err)
+				}
+				if got := treeVersions(graph); !maps.Equal(got, tt.want) {
+					t.Fatalf("Unexpected tree:\n got %v\nwant %v", got, tt.want)
+				}
+				checkEdges(t, graph)
+
+				var paths []string
+				for _, node := range graph.Nodes() {
+					paths = append(paths, node.Path())
+				}
+				if first != nil && !slices.Equal(paths, first) {
+					t.Errorf("Placement is not deterministic:\n%v\n%v", first, paths)
+				}
+				first = paths
+			}
+		})
+	}
+}
+
+// checkEdges verifies every dependency in the graph loads a version that
+// satisfies it.
+func checkEdges(t *testing.T, g *pkg.Graph) {
+	t.Helper()
+	for _, node := range append(g.Nodes(), g.Root) {
+		for name, spec := range node.Dependencies {
+			dep := node.Lookup(name)
+			if dep == nil || dep != node.Edges[name] {
+				t.Errorf("%s should load %s from %v, loads %v", node, name, node.Edges[name], dep)
+				continue
+			}
+			if c, err := semver.NewConstraint(spec); err == nil && !c.Check(semver.MustParse(dep.Version)) {
+				t.Errorf("%s loads %s, which does not satisfy %s", node, dep, spec)
+			}
+		}
+	}
+}
+
+// countingRegistry tracks how many packuments are being fetched at once.
+type countingRegistry struct {
+	pkg.Registry
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (r *countingRegistry) Packument(ctx context.Context, name string) (*pkg.Packument, error) {
+	r.mu.Lock()
+	r.inFlight++
+	r.peak = max(r.peak, r.inFlight)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.inFlight--
+		r.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	return r.Registry.Packument(ctx, name)
+}
+
+func TestResolveFetchesConcurrently(t *testing.T) {
+	packages := []registrytest.Package{{Name: "common", Version: "1.0.0"}}
+	direct := make(map[string]string)
+	for i := range 12 {
+		name := fmt.Sprintf("lib-%02d", i)
+		direct[name] = "^1.0.0"
+		// Each library also needs its own dependency, fetched a level down
+		packages = append(packages,
+			registrytest.Package{Name: name, Version: "1.0.0", Dependencies: map[string]string{"common": "^1.0.0", name + "-dep": "^1.0.0"}},
+			registrytest.Package{Name: name + "-dep", Version: "1.0.0", Dependencies: map[string]string{"common": "^1.0.0"}},
+		)
+	}
+	reg := registrytest.New(t, packages...)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+
+	counting := &countingRegistry{Registry: pkg.NewRegistry()}
+	graph, err := (&pkg.Resolver{Registry: counting, Workers: 4}).Resolve(t.Context(), &pkg.PackageJSON{Dependencies: direct})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if n := len(graph.Nodes()); n != 25 {
+		t.Errorf("Expected 25 packages, got %d", n)
+	}
+	if counting.peak < 2 || counting.peak > 4 {
+		t.Errorf("Expected between 2 and 4 concurrent fetches, got %d", counting.peak)
+	}
+	// Every package is asked for once, however many depend on it
+	for _, p := range packages {
+		if n := reg.Requests("/" + p.Name); n != 1 {
+			t.Errorf("Expected 1 request for %s, got %d", p.Name, n)
+		}
+	}
+	checkEdges(t, graph)
+}
+
+// cancelingRegistry cancels the resolution on the first packument asked for.
+type cancelingRegistry struct {
+	pkg.Registry
+	cancel context.CancelFunc
+}
+
+func (r *cancelingRegistry) Packument(ctx context.Context, name string) (*pkg.Packument, error) {
+	r.cancel()
+	return r.Registry.Packument(ctx, name)
+}
+
+func TestResolveCancel(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "app-lib", Version: "1.0.0", Dependencies: map[string]string{"helper": "^1.0.0"}},
+		registrytest.Package{Name: "helper", Version: "1.0.0"},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	resolver := &pkg.Resolver{Registry: &cancelingRegistry{Registry: pkg.NewRegistry(), cancel: cancel}}
+	_, err := resolver.Resolve(ctx, &pkg.PackageJSON{Dependencies: map[string]string{"app-lib": "^1.0.0"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if n := reg.Requests("/helper"); n != 0 {
+		t.Errorf("Expected no requests after cancelling, got %d", n)
+	}
+}
+
+func TestResolveAbandonsUnneededPrefetches(t *testing.T) {
+	reg := registrytest.New(t, registrytest.Package{Name: "fast", Version: "1.0.0"})
+	upstream, _ := url.Parse(reg.URL)
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+
+	// Both are prefetched, but the optional dependency overrides the other
+	start := time.Now()
+	resolver := &pkg.Resolver{Registry: pkg.NewRegistry()}
+	_, err := resolver.Resolve(t.Context(), &pkg.PackageJSON{
+		Dependencies:         map[string]string{"dep": "npm:slow@^1.0.0"},
+		OptionalDependencies: map[string]string{"dep": "npm:fast@^1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Resolve waited %v for a prefetch it did not need", elapsed)
+	}
+}
+
+func TestResolveCycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		packages []registrytest.Package
+		direct   map[string]string
+		want     map[string]string
+		// edges lists dependencies that close a cycle, as path, name and
+		// the path of the package they resolve to
+		edges [][3]string
+		unmet []string
+	}{
+		{
+			name: "package depending on itself",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "a", "^1.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0"},
+			want:   map[string]string{"a": "1.0.0"},
+			edges:  [][3]string{{"a", "a", "a"}},
+		},
+		{
+			name: "two packages depending on each other",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "b", "^1.0.0"),
+				registrytest.Dep("b", "1.0.0", "a", "^1.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0"},
+			want:   map[string]string{"a": "1.0.0", "b": "1.0.0"},
+			edges:  [][3]string{{"b", "a", "a"}},
+		},
+		{
+			name: "longer cycle below a nested package",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "b", "^1.0.0"),
+				registrytest.Dep("b", "1.0.0", "c", "^1.0.0"),
+				registrytest.Dep("b", "2.0.0"),
+				registrytest.Dep("c", "1.0.0", "a", "^1.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0", "b": "^2.0.0"},
+			want:   map[string]string{"a": "1.0.0", "b": "2.0.0", "c": "1.0.0", "a/node_modules/b": "1.0.0"},
+			edges:  [][3]string{{"c", "a", "a"}},
+		},
+		{
+			name: "cycle through conflicting versions",
+			packages: []registrytest.Package{
+				registrytest.Dep("a", "1.0.0", "b", "^1.0.0"),
+				registrytest.Dep("a", "2.0.0", "b", "^2.0.0"),
+				registrytest.Dep("b", "1.0.0", "a", "^2.0.0"),
+				registrytest.Dep("b", "2.0.0", "a", "^1.0.0"),
+			},
+			direct: map[string]string{"a": "^1.0.0"},
+			want: map[string]string{
+				"a": "1.0.0", "b": "1.0.0",
+				"b/node_modules/a":                "2.0.0",
+				"b/node_modules/b":                "2.0.0",
+				"b/node_modules/b/node_modules/a": "1.0.0",
+			},
+			// Nesting b@1 again would repeat the cycle forever, so a@1 is
+			// left with the b@2 Node.js finds
+			edges: [][3]string{{"b/node_modules/b/node_modules/a", "b", "b/node_modules/b"}},
+			unmet: []string{"a@1.0.0 wants b@^1.0.0, but loads b@2.0.0 from node_modules/b/node_modules/b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registrytest.New(t, tt.packages...)
+			cfg := useTestConfig(t)
+			cfg.Set("registry", reg.URL)
+			t.Chdir(t.TempDir())
+
+			registry := pkg.NewRegistry()
+			resolver := &pkg.Resolver{Registry: registry}
+			pkgJSON := &pkg.PackageJSON{Dependencies: tt.direct}
+			graph, err := resolver.Resolve(t.Context(), pkgJSON)
+			if err != nil {
+				t.Fatalf("Failed to resolve: %v", err)
+			}
+			if got := treeVersions(graph); !maps.Equal(got, tt.want) {
+				t.Fatalf("Unexpected tree:\n got %v\nwant %v", got, tt.want)
+			}
+			for _, edge := range tt.edges {
+				from := graph.Find(edge[0])
+				if got := from.Edges[edge[1]]; got != graph.Find(edge[2]) || got != from.Lookup(edge[1]) {
+					t.Errorf("%s should load %s from %s, got %v", edge[0], edge[1], edge[2], got)
+				}
+			}
+			var unmet []string
+			for _, d := range graph.UnmetDependencies {
+				unmet = append(unmet, d.String())
+			}
+			if !slices.Equal(unmet, tt.unmet) {
+				t.Errorf("Unexpected unmet dependencies:\n got %q\nwant %q", unmet, tt.unmet)
+			}
+
+			// The same tree comes back from the lockfile, and installing it
+			// the way ci does downloads each package once
+			lockfile, devLock := graph.Lock()
+			resolver.Lock = &pkg.PackageLock{Lockfile: lockfile, DevLock: devLock}
+			again, err := resolver.Resolve(t.Context(), pkgJSON)
+			if err != nil {
+				t.Fatalf("Failed to resolve with the lockfile: %v", err)
+			}
+			if got := treeVersions(again); !maps.Equal(got, tt.want) {
+				t.Errorf("Unexpected tree from the lockfile:\n got %v\nwant %v", got, tt.want)
+			}
+
+			locked, err := pkg.LockGraph(resolver.Lock)
+			if err != nil {
+				t.Fatalf("Failed to read the lockfile: %v", err)
+			}
+			if err := pkg.Install(t.Context(), registry, locked, 4); err != nil {
+				t.Fatalf("Failed to install: %v", err)
+			}
+			for path := range tt.want {
+				if _, err := os.Stat(filepath.Join("node_modules", filepath.FromSlash(path), "package.json")); err != nil {
+					t.Errorf("%s not installed: %v", path, err)
+				}
+			}
+			for _, p := range tt.packages {
+				if n := reg.Requests(registrytest.TarballPath(p.Name, p.Version)); n > 1 {
+					t.Errorf("%s@%s downloaded %d times", p.Name, p.Version, n)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveAliases(t *testing.T) {
+	reg := registrytest.New(t,
+		registrytest.Package{Name: "lodash", Version: "3.10.1"},
+		registrytest.Package{Name: "lodash", Version: "4.17.21"},
+		registrytest.Package{Name: "legacy", Version: "1.0.0", Dependencies: map[string]string{"lodash": "^4.0.0", "old-lodash": "npm:lodash@^3.0.0"}},
+	)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", reg.URL)
+	t.Chdir(t.TempDir())
+
+	pkgJSON := &pkg.PackageJSON{Dependencies: map[string]string{
+		"legacy":  "^1.0.0",
+		"lodash":  "^3.0.0",
+		"lodash4": "npm:lodash@^4",
+	}}
+	registry := pkg.NewRegistry()
+	resolver := &pkg.Resolver{Registry: registry}
+	graph, err := resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	// The alias folder does not provide lodash, so legacy needs its own
+	want := map[string]string{
+		"legacy":                     "1.0.0",
+		"lodash":                     "3.10.1",
+		"lodash4":                    "4.17.21",
+		"old-lodash":                 "3.10.1",
+		"legacy/node_modules/lodash": "4.17.21",
+	}
+	if got := treeVersions(graph); !maps.Equal(got, want) {
+		t.Errorf("Unexpected tree:\n got %v\nwant %v", got, want)
+	}
+	checkEdges(t, graph)
+	if got := graph.Find("lodash4").String(); got != "lodash4@npm:lodash@4.17.21" {
+		t.Errorf("Unexpected alias name %q", got)
+	}
+
+	lockfile, devLock := graph.Lock()
+	if dep := lockfile["lodash4"]; dep.Name != "lodash" || dep.Resolved != reg.TarballURL("lodash", "4.17.21") {
+		t.Errorf("Expected the aliased package in the lockfile, got %+v", dep)
+	}
+	if dep := lockfile["lodash"]; dep.Name != "" {
+		t.Errorf("Only aliases should record a name, got %q", dep.Name)
+	}
+
+	if err := pkg.Install(t.Context(), registry, graph, 4); err != nil {
+		t.Fatalf("Failed to install: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join("node_modules", "lodash4", "package.json"))
+	if err != nil {
+		t.Fatalf("Alias not installed under its own name: %v", err)
+	}
+	var manifest pkg.PackageJSON
+	json.Unmarshal(data, &manifest)
+	if manifest.Name != "lodash" || manifest.Version != "4.17.21" {
+		t.Errorf("Expected lodash@4.17.21 in node_modules/lodash4, got %s@%s", manifest.Name, manifest.Version)
+	}
+
+	// The lockfile keeps the aliases without fetching metadata again
+	before := reg.Requests("/lodash")
+	resolver.Lock = &pkg.PackageLock{Lockfile: lockfile, DevLock: devLock}
+	relocked, err := resolver.Resolve(t.Context(), pkgJSON)
+	if err != nil {
+		t.Fatalf("Failed to resolve with the lockfile: %v", err)
+	}
+	if got := treeVersions(relocked); !maps.Equal(got, want) {
+		t.Errorf("Unexpected tree from the lockfile:\n got %v\nwant %v", got, want)
+	}
+	if after := reg.Requests("/lodash"); after != before {
+		t.Errorf("Expected no metadata requests with a lockfile, got %d", after-before)
+	}
+
+	locked, err := pkg.LockGraph(resolver.Lock)
+	if err != nil {
+		t.Fatalf("Failed to read the lockfile: %v", err)
+	}
+	if got := locked.Find("old-lodash"); got.PackageName != "lodash" || locked.Find("legacy").Edges["old-lodash"] != got {
+		t.Errorf("Expected legacy to load lodash through its alias, got %+v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+type SpecType string
+
+const (
+	SpecVersion SpecType = "version"
+	SpecRange   SpecType = "range"
+	SpecTag     SpecType = "tag"
+	SpecAlias   SpecType = "alias"
+)
+
+// PackageSpec is a parsed dependency specifier such as "lodash@^4",
+// "@types/node@latest" or "lodash4@npm:lodash@^4".
+type PackageSpec struct {
+	Name      string
+	Type      SpecType
+	FetchSpec string
+	// Subspec is the real package behind an alias.
+	Subspec *PackageSpec
+}
+
+var (
+	tagPattern      = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._~-]*$`)
+	namePartPattern = regexp.MustCompile(`^[A-Za-z0-9~-][A-Za-z0-9._~-]*$`)
+)
+
+// ParsePackageSpec parses a command line argument of the form name[@spec].
+// A missing spec means the "latest" tag.
+func ParsePackageSpec(arg string) (*PackageSpec, error) {
+	name, spec := arg, ""
+	// Skip the leading "@" of a scope when looking for the separator.
+	start := 0
+	if strings.HasPrefix(arg, "@") {
+		start = 1
+	}
+	if i := strings.Index(arg[start:], "@"); i >= 0 {
+		name, spec = arg[:start+i], arg[start+i+1:]
+		if spec == "" {
+			return nil, fmt.Errorf("invalid package spec %q: empty version", arg)
+		}
+	}
+	if spec == "" {
+		spec = "latest"
+	}
+	return ResolvePackageSpec(name, spec)
+}
+
+// ResolvePackageSpec parses a name and spec pair as found in the
+// dependencies of a package.json. An empty spec matches any version.
+func ResolvePackageSpec(name, spec string) (*PackageSpec, error) {
+	if err := ValidatePackageName(name); err != nil {
+		return nil, err
+	}
+
+	spec = strings.TrimSpace(spec)
+	result := &PackageSpec{Name: name, FetchSpec: spec}
+
+	if target, ok := strings.CutPrefix(spec, "npm:"); ok {
+		sub, err := ParsePackageSpec(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alias %s@%s: %w", name, spec, err)
+		}
+		if sub.Type == SpecAlias {
+			return nil, fmt.Errorf("invalid alias %s@%s: nested aliases are not supported", name, spec)
+		}
+		result.Type = SpecAlias
+		result.Subspec = sub
+		return result, nil
+	}
+
+	if spec == "" {
+		result.Type = SpecRange
+		result.FetchSpec = "*"
+		return result, nil
+	}
+
+	exact := strings.TrimPrefix(strings.TrimPrefix(spec, "="), "v")
+	if v, err := semver.StrictNewVersion(exact); err == nil {
+		result.Type = SpecVersion
+		result.FetchSpec = v.String()
+		return result, nil
+	}
+	if _, err := semver.NewConstraint(spec); err == nil {
+		result.Type = SpecRange
+		return result, nil
+	}
+	if tagPattern.MatchString(spec) {
+		result.Type = SpecTag
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported version spec %q for %s", spec, name)
+}
+
+// Target is the spec of the package to fetch: the real package behind an
+// alias, or the spec itself. Its Name is the one the package is published
+// under.
+func (s *PackageSpec) Target() *PackageSpec {
+	if s.Subspec != nil {
+		return s.Subspec
+	}
+	return s
+}
+
+func (s *PackageSpec) String() string {
+	if s.Subspec != nil {
+		return s.Name + "@npm:" + s.Subspec.String()
+	}
+	return s.Name + "@" + s.FetchSpec
+}
+
+// ValidatePackageName reports whether name is a valid, possibly scoped,
+// npm package name.
+func ValidatePackageName(name string) error {
+	if name == "" {
+		return fmt.Errorf("package name cannot be empty")
+	}
+	if len(name) > 214 {
+		return fmt.Errorf("invalid package name %q: longer than 214 characters", name)
+	}
+
+	bare := name
+	if strings.HasPrefix(name, "@") {
+		scope, rest, ok := strings.Cut(name[1:], "/")
+		if !ok || !namePartPattern.MatchString(scope) {
+			return fmt.Errorf("invalid package name %q: bad scope", name)
+		}
+		bare = rest
+	}
+	if !namePartPattern.MatchString(bare) {
+		return fmt.Errorf("invalid package name %q", name)
+	}
+	return nil
+}
+
+// EscapePackageName encodes a package name for use as a registry URL path,
+// turning "@types/node" into "@types%2Fnode".
+func EscapePackageName(name string) string {
+	return url.PathEscape(name)
+}
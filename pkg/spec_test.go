@@ -0,0 +1,81 @@
+package pkg_test
+
+import (
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+func TestParsePackageSpec(t *testing.T) {
+	tests := []struct {
+		arg       string
+		name      string
+		specType  pkg.SpecType
+		fetchSpec string
+		registry  string
+	}{
+		{"lodash", "lodash", pkg.SpecTag, "latest", "lodash"},
+		{"lodash@4.17.21", "lodash", pkg.SpecVersion, "4.17.21", "lodash"},
+		{"lodash@v4.17.21", "lodash", pkg.SpecVersion, "4.17.21", "lodash"},
+		{"lodash@^4.0.0", "lodash", pkg.SpecRange, "^4.0.0", "lodash"},
+		{"lodash@>=1 <3", "lodash", pkg.SpecRange, ">=1 <3", "lodash"},
+		{"lodash@next", "lodash", pkg.SpecTag, "next", "lodash"},
+		{"@types/node", "@types/node", pkg.SpecTag, "latest", "@types/node"},
+		{"@types/node@1.0.0", "@types/node", pkg.SpecVersion, "1.0.0", "@types/node"},
+		{"@types/node@~18", "@types/node", pkg.SpecRange, "~18", "@types/node"},
+		{"lodash4@npm:lodash@^4", "lodash4", pkg.SpecAlias, "npm:lodash@^4", "lodash"},
+		{"node-types@npm:@types/node", "node-types", pkg.SpecAlias, "npm:@types/node", "@types/node"},
+	}
+
+	for _, tt := range tests {
+		spec, err := pkg.ParsePackageSpec(tt.arg)
+		if err != nil {
+			t.Errorf("ParsePackageSpec(%q) failed: %v", tt.arg, err)
+			continue
+		}
+		if spec.Name != tt.name || spec.Type != tt.specType || spec.FetchSpec != tt.fetchSpec {
+			t.Errorf("ParsePackageSpec(%q) = %s %s %q, want %s %s %q",
+				tt.arg, spec.Name, spec.Type, spec.FetchSpec, tt.name, tt.specType, tt.fetchSpec)
+		}
+		if got := spec.Target().Name; got != tt.registry {
+			t.Errorf("ParsePackageSpec(%q).Target().Name = %s, want %s", tt.arg, got, tt.registry)
+		}
+	}
+}
+
+func TestParsePackageSpecInvalid(t *testing.T) {
+	for _, arg := range []string{
+		"",
+		"@types",
+		"@/node",
+		"lodash@",
+		".hidden",
+		"_private",
+		"has space",
+		"lodash@git+https://github.com/lodash/lodash.git",
+		"a@npm:b@npm:c",
+	} {
+		if spec, err := pkg.ParsePackageSpec(arg); err == nil {
+			t.Errorf("ParsePackageSpec(%q) = %+v, expected error", arg, spec)
+		}
+	}
+}
+
+func TestResolvePackageSpecEmptyIsAnyVersion(t *testing.T) {
+	spec, err := pkg.ResolvePackageSpec("lodash", "")
+	if err != nil {
+		t.Fatalf("Failed to resolve spec: %v", err)
+	}
+	if spec.Type != pkg.SpecRange || spec.FetchSpec != "*" {
+		t.Errorf("Unexpected spec: %+v", spec)
+	}
+}
+
+func TestEscapePackageName(t *testing.T) {
+	if got := pkg.EscapePackageName("@types/node"); got != "@types%2Fnode" {
+		t.Errorf("Unexpected escaped name: %s", got)
+	}
+	if got := pkg.EscapePackageName("lodash"); got != "lodash" {
+		t.Errorf("Unexpected escaped name: %s", got)
+	}
+}
@@ -0,0 +1,299 @@
+package pkg
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Store is a global, content-addressable directory of extracted packages
+// keyed by their integrity hash. Projects get their node_modules populated
+// from it by hard links, so each tarball is downloaded once per machine.
+type Store struct {
+	Dir string
+}
+
+type StoreStatus struct {
+	Packages int
+	Bytes    int64
+	Projects []string
+}
+
+// DefaultStore returns the store at the configured store-dir, defaulting to
+// ~/.snpm/store.
+func DefaultStore() *Store {
+	if dir := Cfg.Get("store-dir"); dir != "" {
+		return &Store{Dir: dir}
+	}
+	return &Store{Dir: filepath.Join(snpmHome(), "store")}
+}
+
+func snpmHome() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".snpm"
+	}
+	return filepath.Join(home, ".snpm")
+}
+
+// PackagePath is where the package with the given integrity lives in the
+// store, whether or not it has been added yet.
+func (s *Store) PackagePath(integrity string) (string, error) {
+	parsed, err := ParseIntegrity(integrity)
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(parsed.Digest)
+	return filepath.Join(s.Dir, "v1", parsed.Algorithm, digest[:2], digest[2:]), nil
+}
+
+// Ensure makes sure the tarball is in the store, downloading it from reg and
+// verifying it only if it is missing, and returns its location.
+func (s *Store) Ensure(ctx context.Context, reg Registry, url, integrity string) (string, error) {
+	path, err := s.PackagePath(integrity)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := reg.Tarball(ctx, url, path, integrity); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Link populates dest with the package stored at path using hard links,
+// falling back to copies when linking is not possible, for example across
+// filesystems. Like extraction it stages into a temp dir first, which keeps
+// its own mode rather than the stored package's, private in stores written
+// before package roots were made readable.
+func (s *Store) Link(path, dest string) error {
+	tmp, err := makeTempDir(dest)
+	if err != nil {
+		return err
+	}
+	if err := linkTree(path, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return replaceDir(tmp, dest)
+}
+
+func linkTree(src, dest string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+			in, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			return writeFile(target, in, info.Mode().Perm())
+		}
+	})
+}
+
+// RegisterProject records a project directory using the store, so that
+// Prune knows which packages are still referenced.
+func (s *Store) RegisterProject(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	projects, err := s.projects()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(projects, abs) {
+		return nil
+	}
+	return s.saveProjects(append(projects, abs))
+}
+
+func (s *Store) Status() (*StoreStatus, error) {
+	projects, err := s.projects()
+	if err != nil {
+		return nil, err
+	}
+	status := &StoreStatus{Projects: projects}
+	err = s.walkPackages(func(path string) error {
+		if strings.Contains(filepath.Base(path), tempMarker) {
+			return nil
+		}
+		status.Packages++
+		return filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			status.Bytes += info.Size()
+			return nil
+		})
+	})
+	return status, err
+}
+
+// staleStagingAge is how old a staging directory in the store has to be
+// for Prune to take it for a leftover rather than a download in progress.
+const staleStagingAge = 24 * time.Hour
+
+// Prune deletes every stored package that is not in the lockfile of a
+// registered project, along with staging directories left by interrupted
+// downloads, and forgets projects whose lockfile no longer exists. A
+// lockfile that cannot be read stops it, as the packages it references are
+// unknown.
+func (s *Store) Prune() (int, error) {
+	projects, err := s.projects()
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[string]bool)
+	var alive []string
+	for _, project := range projects {
+		lockPath := filepath.Join(project, "package-lock.json")
+		lock, err := LoadPackageLock(lockPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot tell which packages %s uses: %w", lockPath, err)
+		}
+		alive = append(alive, project)
+		for _, deps := range []map[string]LockedDependency{lock.Lockfile, lock.DevLock} {
+			for _, dep := range deps {
+				if dep.Integrity == "" {
+					continue
+				}
+				if path, err := s.PackagePath(dep.Integrity); err == nil {
+					referenced[path] = true
+				}
+			}
+		}
+	}
+
+	removed := 0
+	err = s.walkPackages(func(path string) error {
+		if referenced[path] {
+			return nil
+		}
+		if strings.Contains(filepath.Base(path), tempMarker) {
+			// Another install may still be extracting into it
+			info, err := os.Lstat(path)
+			if err != nil || time.Since(info.ModTime()) < staleStagingAge {
+				return nil
+			}
+		} else {
+			removed++
+		}
+		return os.RemoveAll(path)
+	})
+	if err != nil {
+		return removed, err
+	}
+	return removed, s.saveProjects(alive)
+}
+
+// walkPackages calls fn for every entry in the store, including staging
+// directories of downloads that are in progress or were interrupted.
+func (s *Store) walkPackages(fn func(path string) error) error {
+	algorithms, err := os.ReadDir(filepath.Join(s.Dir, "v1"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, algo := range algorithms {
+		algoDir := filepath.Join(s.Dir, "v1", algo.Name())
+		prefixes, err := os.ReadDir(algoDir)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			prefixDir := filepath.Join(algoDir, prefix.Name())
+			entries, err := os.ReadDir(prefixDir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := fn(filepath.Join(prefixDir, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) projectsFile() string {
+	return filepath.Join(s.Dir, "projects.json")
+}
+
+func (s *Store) projects() ([]string, error) {
+	data, err := os.ReadFile(s.projectsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var projects []string
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+func (s *Store) saveProjects(projects []string) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(projects, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.projectsFile(), data, 0644)
+}
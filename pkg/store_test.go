@@ -0,0 +1,186 @@
+package pkg_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestStoreDownloadsOnceAndHardlinks(t *testing.T) {
+	tarball := registrytest.Tarball(map[string]string{"index.js": "module.exports = 1"})
+	integrity := registrytest.Integrity(tarball)
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	store := &pkg.Store{Dir: filepath.Join(t.TempDir(), "store")}
+	projectA := filepath.Join(t.TempDir(), "node_modules", "pkg")
+	projectB := filepath.Join(t.TempDir(), "node_modules", "pkg")
+
+	for _, dest := range []string{projectA, projectB} {
+		path, err := store.Ensure(t.Context(), pkg.NewRegistry(), srv.URL, integrity)
+		if err != nil {
+			t.Fatalf("Failed to add package to store: %v", err)
+		}
+		if err := store.Link(path, dest); err != nil {
+			t.Fatalf("Failed to link package: %v", err)
+		}
+	}
+
+	if hits != 1 {
+		t.Errorf("Expected one download, got %d", hits)
+	}
+
+	infoA, err := os.Stat(filepath.Join(projectA, "index.js"))
+	if err != nil {
+		t.Fatalf("Package not linked: %v", err)
+	}
+	infoB, _ := os.Stat(filepath.Join(projectB, "index.js"))
+	if !os.SameFile(infoA, infoB) {
+		t.Errorf("Expected projects to share the stored file")
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	used := registrytest.Tarball(map[string]string{"index.js": "used"})
+	unused := registrytest.Tarball(map[string]string{"index.js": "unused"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/used.tgz" {
+			w.Write(used)
+		} else {
+			w.Write(unused)
+		}
+	}))
+	defer srv.Close()
+
+	store := &pkg.Store{Dir: filepath.Join(t.TempDir(), "store")}
+	usedPath, err := store.Ensure(t.Context(), pkg.NewRegistry(), srv.URL+"/used.tgz", registrytest.Integrity(used))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unusedPath, err := store.Ensure(t.Context(), pkg.NewRegistry(), srv.URL+"/unused.tgz", registrytest.Integrity(unused))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	project := t.TempDir()
+	pkg.SavePackageLock(filepath.Join(project, "package-lock.json"), &pkg.PackageLock{
+		Lockfile: map[string]pkg.LockedDependency{
+			"used": {Version: "1.0.0", Integrity: registrytest.Integrity(used)},
+		},
+	})
+	store.RegisterProject(project)
+	store.RegisterProject(filepath.Join(t.TempDir(), "deleted"))
+
+	// A download in progress is kept, one interrupted long ago is removed
+	staging := filepath.Join(filepath.Dir(unusedPath), ".new.snpm-tmp-1")
+	leftover := filepath.Join(filepath.Dir(unusedPath), ".old.snpm-tmp-2")
+	os.MkdirAll(staging, 0755)
+	os.MkdirAll(leftover, 0755)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(leftover, old, old)
+
+	status, err := store.Status()
+	if err != nil {
+		t.Fatalf("Failed to read store status: %v", err)
+	}
+	if status.Packages != 2 || len(status.Projects) != 2 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	removed, err := store.Prune()
+	if err != nil {
+		t.Fatalf("Failed to prune store: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 removed package, got %d", removed)
+	}
+	if _, err := os.Stat(usedPath); err != nil {
+		t.Errorf("Referenced package was pruned")
+	}
+	if _, err := os.Stat(unusedPath); !os.IsNotExist(err) {
+		t.Errorf("Unreferenced package was kept")
+	}
+	if _, err := os.Stat(staging); err != nil {
+		t.Errorf("Staging directory of a download in progress was pruned")
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Leftover staging directory was kept")
+	}
+
+	status, _ = store.Status()
+	if len(status.Projects) != 1 || status.Projects[0] != project {
+		t.Errorf("Expected deleted project to be forgotten, got %v", status.Projects)
+	}
+}
+
+func TestStoreLinkedPackageIsReadable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix permissions")
+	}
+	tarball := registrytest.Tarball(map[string]string{"lib/index.js": "module.exports = 1"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	store := &pkg.Store{Dir: filepath.Join(t.TempDir(), "store")}
+	path, err := store.Ensure(t.Context(), pkg.NewRegistry(), srv.URL, registrytest.Integrity(tarball))
+	if err != nil {
+		t.Fatalf("Failed to add package to store: %v", err)
+	}
+	// Stores written by earlier versions have private package roots
+	os.Chmod(path, 0700)
+
+	dest := filepath.Join(t.TempDir(), "node_modules", "pkg")
+	if err := store.Link(path, dest); err != nil {
+		t.Fatalf("Failed to link package: %v", err)
+	}
+	for _, dir := range []string{dest, filepath.Join(dest, "lib")} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("Package not linked: %v", err)
+		}
+		if got := info.Mode().Perm(); got != 0755 {
+			t.Errorf("Expected %s to be 0755, got %o", dir, got)
+		}
+	}
+}
+
+func TestStorePruneKeepsProjectsWithUnreadableLockfiles(t *testing.T) {
+	tarball := registrytest.Tarball(map[string]string{"index.js": "used"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	store := &pkg.Store{Dir: filepath.Join(t.TempDir(), "store")}
+	path, err := store.Ensure(t.Context(), pkg.NewRegistry(), srv.URL, registrytest.Integrity(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, "package-lock.json"), []byte("{ half a lockfile"), 0644)
+	store.RegisterProject(project)
+
+	if _, err := store.Prune(); err == nil {
+		t.Errorf("Expected an unreadable lockfile to stop pruning")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Package of a project with an unreadable lockfile was pruned")
+	}
+	if status, _ := store.Status(); len(status.Projects) != 1 {
+		t.Errorf("Project with an unreadable lockfile was forgotten: %v", status.Projects)
+	}
+}
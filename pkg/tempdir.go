@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempMarker is part of the name of every directory snpm stages packages in.
+// Anything carrying it that is still around at the start of an install was
+// left by an interrupted run.
+const tempMarker = ".snpm-tmp-"
+
+// makeTempDir creates an empty staging directory next to dest, on the same
+// filesystem so it can later be renamed into place. It becomes the package
+// root, which tarballs carry no mode for, so it is made readable by everyone
+// rather than left private like os.MkdirTemp makes it.
+func makeTempDir(dest string) (string, error) {
+	parent := filepath.Dir(dest)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(dest)+tempMarker+"*")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// replaceDir moves the staged directory tmp to dest. An existing dest is
+// first moved aside and only deleted once the new one is in place, so dest
+// is always either the complete old or the complete new version.
+func replaceDir(tmp, dest string) error {
+	old := ""
+	if _, err := os.Lstat(dest); err == nil {
+		old = tmp + "-old"
+		if err := os.Rename(dest, old); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		if old != "" {
+			os.Rename(old, dest)
+		}
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// CleanupTempDirs removes staging directories left in a node_modules tree by
+// interrupted installs, including those in scopes and nested node_modules.
+func CleanupTempDirs(nodeModules string) error {
+	entries, err := os.ReadDir(nodeModules)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(nodeModules, entry.Name())
+		switch {
+		case strings.Contains(entry.Name(), tempMarker):
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		case !entry.IsDir():
+		case strings.HasPrefix(entry.Name(), "@"):
+			if err := CleanupTempDirs(path); err != nil {
+				return err
+			}
+		default:
+			if err := CleanupTempDirs(filepath.Join(path, "node_modules")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
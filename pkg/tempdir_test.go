@@ -0,0 +1,107 @@
+package pkg_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/sojebsikder/go-npm/pkg"
+	"github.com/sojebsikder/go-npm/pkg/registrytest"
+)
+
+func TestFailedExtractionKeepsPreviousVersion(t *testing.T) {
+	good := registrytest.Tarball(map[string]string{"index.js": "v2"})
+	// A truncated download fails halfway through decompression
+	truncated := good[:len(good)/2]
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/truncated.tgz" {
+			w.Write(truncated)
+			return
+		}
+		w.Write(good)
+	}))
+	defer srv.Close()
+
+	nodeModules := filepath.Join(t.TempDir(), "node_modules")
+	dest := filepath.Join(nodeModules, "pkg")
+	os.MkdirAll(dest, 0755)
+	os.WriteFile(filepath.Join(dest, "index.js"), []byte("v1"), 0644)
+
+	if err := pkg.DownloadAndExtractTarball(srv.URL+"/truncated.tgz", dest, ""); err == nil {
+		t.Fatalf("Expected truncated tarball to fail")
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "index.js")); string(content) != "v1" {
+		t.Errorf("Previous version was touched by failed install: %q", content)
+	}
+
+	if err := pkg.DownloadAndExtractTarball(srv.URL+"/good.tgz", dest, ""); err != nil {
+		t.Fatalf("Failed to extract tarball: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dest, "index.js")); string(content) != "v2" {
+		t.Errorf("Package was not replaced: %q", content)
+	}
+
+	entries, _ := os.ReadDir(nodeModules)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the package directory, found %d entries", len(entries))
+	}
+}
+
+func TestCleanupTempDirs(t *testing.T) {
+	nodeModules := filepath.Join(t.TempDir(), "node_modules")
+	leftovers := []string{
+		filepath.Join(nodeModules, ".lodash.snpm-tmp-123"),
+		filepath.Join(nodeModules, "@types", ".node.snpm-tmp-456"),
+		filepath.Join(nodeModules, "a", "node_modules", ".b.snpm-tmp-789-old"),
+	}
+	kept := []string{
+		filepath.Join(nodeModules, "lodash"),
+		filepath.Join(nodeModules, "@types", "node"),
+		filepath.Join(nodeModules, "a", "node_modules", "b"),
+	}
+	for _, dir := range append(leftovers, kept...) {
+		os.MkdirAll(dir, 0755)
+	}
+
+	if err := pkg.CleanupTempDirs(nodeModules); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	for _, dir := range leftovers {
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Leftover %s was not removed", dir)
+		}
+	}
+	for _, dir := range kept {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("Package %s was removed", dir)
+		}
+	}
+}
+
+func TestStagedPackageIsReadable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix permissions")
+	}
+	tarball := registrytest.Tarball(map[string]string{"index.js": "module.exports = 1"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+
+	dest := filepath.Join(t.TempDir(), "node_modules", "pkg")
+	if err := pkg.DownloadAndExtractTarball(srv.URL, dest, ""); err != nil {
+		t.Fatalf("Failed to extract tarball: %v", err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("Package not extracted: %v", err)
+	}
+	if got := info.Mode().Perm(); got != 0755 {
+		t.Errorf("Expected the package directory to be 0755, got %o", got)
+	}
+}
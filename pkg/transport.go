@@ -0,0 +1,217 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxSockets is npm's default for maxsockets, the number of
+// connections kept open to a single host.
+const defaultMaxSockets = 15
+
+// transportKeys are the settings a transport is built from. Changing any of
+// them makes the next request use a new transport.
+var transportKeys = []string{"maxsockets", "proxy", "https-proxy", "noproxy", "strict-ssl", "ca", "cafile", "cert", "key", "certfile", "keyfile"}
+
+var (
+	transportMu  sync.Mutex
+	transportFor string
+	transport    *http.Transport
+)
+
+// configTransport sends requests through the transport built from Cfg.
+type configTransport struct{}
+
+func (configTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, err := Cfg.transport()
+	if err != nil {
+		return nil, err
+	}
+	return t.RoundTrip(req)
+}
+
+// transport returns the http.Transport shared by all requests, honoring the
+// proxy and TLS settings. It is reused while they are unchanged so
+// connections are kept alive between requests.
+func (c *Config) transport() (*http.Transport, error) {
+	var key strings.Builder
+	for _, k := range transportKeys {
+		key.WriteString(c.Get(k) + "\x00")
+	}
+	for _, env := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"} {
+		key.WriteString(proxyEnv(env) + "\x00")
+	}
+
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if transport != nil && transportFor == key.String() {
+		return transport, nil
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t := newTransport(int(c.Int("maxsockets", defaultMaxSockets)))
+	t.Proxy = c.proxyFor
+	t.TLSClientConfig = tlsConfig
+
+	if transport != nil {
+		transport.CloseIdleConnections()
+	}
+	transport, transportFor = t, key.String()
+	return t, nil
+}
+
+// newTransport is tuned for installs, which make hundreds of requests to
+// the same one or two hosts. http.DefaultTransport keeps only two idle
+// connections per host, so most requests of a parallel install would pay
+// for a new TCP and TLS handshake. Here up to maxSockets connections per
+// host are opened and all of them are kept alive for reuse, and HTTP/2 is
+// negotiated where the registry supports it, multiplexing requests over a
+// single connection.
+func newTransport(maxSockets int) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxConnsPerHost = maxSockets
+	t.MaxIdleConnsPerHost = maxSockets
+	t.MaxIdleConns = max(100, 4*maxSockets)
+	t.IdleConnTimeout = 90 * time.Second
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.ForceAttemptHTTP2 = true
+	return t
+}
+
+// proxyFor picks the proxy for a request: https-proxy for https URLs,
+// proxy otherwise and for https when https-proxy is unset, and the
+// HTTPS_PROXY and HTTP_PROXY environment variables when neither is set.
+// Hosts matching noproxy, or NO_PROXY, are reached directly.
+func (c *Config) proxyFor(req *http.Request) (*url.URL, error) {
+	noproxy := c.Get("noproxy")
+	if noproxy == "" {
+		noproxy = proxyEnv("NO_PROXY")
+	}
+	if matchNoProxy(noproxy, req.URL.Hostname()) {
+		return nil, nil
+	}
+
+	proxy := c.Get("proxy")
+	if req.URL.Scheme == "https" {
+		if httpsProxy := c.Get("https-proxy"); httpsProxy != "" {
+			proxy = httpsProxy
+		}
+		if proxy == "" {
+			proxy = proxyEnv("HTTPS_PROXY")
+		}
+	}
+	if proxy == "" {
+		proxy = proxyEnv("HTTP_PROXY")
+	}
+	if proxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		// Allow host:port without a scheme
+		u, err = url.Parse("http://" + proxy)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %w", redactURL(proxy), err)
+	}
+	return u, nil
+}
+
+func proxyEnv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// matchNoProxy reports whether host is listed in noproxy, a comma
+// separated list of host names and domain suffixes, or "*".
+func matchNoProxy(noproxy, host string) bool {
+	for _, entry := range strings.Split(noproxy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig adds the certificate authorities from cafile and ca to the
+// system ones, loads the client certificate from certfile and keyfile or the
+// inline cert and key, and disables verification when strict-ssl is false.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if c.Get("strict-ssl") != "" && !c.Bool("strict-ssl") {
+		config.InsecureSkipVerify = true
+	}
+
+	var caPEM []byte
+	if cafile := c.Get("cafile"); cafile != "" {
+		data, err := os.ReadFile(cafile)
+		if err != nil {
+			return nil, fmt.Errorf("reading cafile: %w", err)
+		}
+		caPEM = append(caPEM, data...)
+	}
+	if ca := c.Get("ca"); ca != "" {
+		caPEM = append(caPEM, '\n')
+		caPEM = append(caPEM, pemValue(ca)...)
+	}
+	if len(caPEM) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in ca or cafile")
+		}
+		config.RootCAs = pool
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case c.Get("certfile") != "" || c.Get("keyfile") != "":
+		cert, err = tls.LoadX509KeyPair(c.Get("certfile"), c.Get("keyfile"))
+	case c.Get("cert") != "" || c.Get("key") != "":
+		cert, err = tls.X509KeyPair(pemValue(c.Get("cert")), pemValue(c.Get("key")))
+	default:
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// pemValue turns the escaped newlines npmrc files use for inline
+// certificates back into real ones.
+func pemValue(value string) []byte {
+	return []byte(strings.ReplaceAll(value, `\n`, "\n"))
+}
@@ -0,0 +1,364 @@
+package pkg_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sojebsikder/go-npm/pkg"
+)
+
+const securePackument = `{"name":"secure","versions":{"1.0.0":{}}}`
+
+func serveSecurePackument(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(securePackument))
+}
+
+// writeCertPEM saves the certificate of a TLS test server for use as cafile.
+func writeCertPEM(t testing.TB, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(serveSecurePackument))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("fetch-retries", "0")
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err == nil {
+		t.Fatalf("Expected unknown certificate authority to be rejected")
+	}
+
+	cfg.Set("cafile", writeCertPEM(t, srv))
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Failed to fetch with cafile: %v", err)
+	}
+
+	// Inline ca with escaped newlines, as written in .npmrc. Each step uses
+	// a fresh cache, so earlier documents are not used as stale fallback.
+	cfg.Set("cache", t.TempDir())
+	pkg.ResetMetadataMemo()
+	data, _ := os.ReadFile(cfg.Get("cafile"))
+	cfg.Set("cafile", "")
+	cfg.Set("ca", strings.ReplaceAll(string(data), "\n", `\n`))
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Failed to fetch with ca: %v", err)
+	}
+
+	cfg.Set("cache", t.TempDir())
+	cfg.Set("ca", "")
+	cfg.Set("cafile", filepath.Join(t.TempDir(), "missing.pem"))
+	pkg.ResetMetadataMemo()
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err == nil || !strings.Contains(err.Error(), "cafile") {
+		t.Errorf("Expected cafile error, got %v", err)
+	}
+}
+
+func TestStrictSSLDisabled(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(serveSecurePackument))
+	defer srv.Close()
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("strict-ssl", "false")
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Expected strict-ssl=false to accept any certificate: %v", err)
+	}
+}
+
+// newProxy starts a forward proxy handling plain requests and CONNECT
+// tunnels, recording what it was asked for and the credentials it got.
+func newProxy(t *testing.T) (*httptest.Server, func() (requests []string, auth string)) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []string
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.Host)
+		auth = r.Header.Get("Proxy-Authorization")
+		mu.Unlock()
+
+		if r.Method != http.MethodConnect {
+			serveSecurePackument(w, r)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, client)
+			upstream.Close()
+		}()
+		io.Copy(client, upstream)
+		client.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() ([]string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...), auth
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxy, seen := newProxy(t)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", "http://registry.internal.test/")
+	cfg.Set("fetch-retries", "0")
+	cfg.Set("proxy", strings.Replace(proxy.URL, "http://", "http://alice:s3cret@", 1))
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Failed to fetch through proxy: %v", err)
+	}
+	requests, auth := seen()
+	if len(requests) != 1 || requests[0] != "GET registry.internal.test" {
+		t.Errorf("Unexpected proxy requests: %v", requests)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:s3cret")); auth != want {
+		t.Errorf("Proxy credentials not sent, got %q", auth)
+	}
+
+	// noproxy hosts bypass the proxy, and this one does not resolve
+	cfg.Set("cache", t.TempDir())
+	pkg.ResetMetadataMemo()
+	cfg.Set("noproxy", "localhost,.internal.test")
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err == nil {
+		t.Errorf("Expected noproxy host to be reached directly")
+	}
+	if requests, _ := seen(); len(requests) != 1 {
+		t.Errorf("noproxy host went through the proxy: %v", requests)
+	}
+}
+
+func TestHTTPSProxyTunnels(t *testing.T) {
+	registry := httptest.NewTLSServer(http.HandlerFunc(serveSecurePackument))
+	defer registry.Close()
+	proxy, seen := newProxy(t)
+	cfg := useTestConfig(t)
+	cfg.Set("registry", registry.URL)
+	cfg.Set("cafile", writeCertPEM(t, registry))
+	cfg.Set("https-proxy", proxy.URL)
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Failed to fetch through https-proxy: %v", err)
+	}
+	requests, _ := seen()
+	if len(requests) != 1 || requests[0] != "CONNECT "+registry.Listener.Addr().String() {
+		t.Errorf("Expected a CONNECT tunnel, got %v", requests)
+	}
+}
+
+// newClientCert creates a self-signed client certificate and returns the
+// paths of its PEM certificate and key files.
+func newClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "snpm test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestClientCertificate(t *testing.T) {
+	clientCert, certFile, keyFile := newClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(serveSecurePackument))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("cafile", writeCertPEM(t, srv))
+	cfg.Set("fetch-retries", "0")
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err == nil {
+		t.Fatalf("Expected server to require a client certificate")
+	}
+
+	cfg.Set("certfile", certFile)
+	cfg.Set("keyfile", keyFile)
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Failed to fetch with client certificate: %v", err)
+	}
+}
+
+// newCountingServer starts a TLS server serving a packument and counting
+// the connections opened to it.
+func newCountingServer(tb testing.TB, http2 bool, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	tb.Helper()
+	conns := &atomic.Int64{}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = http2
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	tb.Cleanup(srv.Close)
+	return srv, conns
+}
+
+func TestTransportNegotiatesHTTP2(t *testing.T) {
+	var proto atomic.Value
+	srv, _ := newCountingServer(t, true, func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		serveSecurePackument(w, r)
+	})
+	cfg := useTestConfig(t)
+	cfg.Set("registry", srv.URL)
+	cfg.Set("cafile", writeCertPEM(t, srv))
+
+	if _, err := pkg.NewRegistry().Packument(t.Context(), "secure"); err != nil {
+		t.Fatalf("Failed to fetch package metadata: %v", err)
+	}
+	if got := proto.Load(); got != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2, got %v", got)
+	}
+}
+
+func TestTransportReusesConnections(t *testing.T) {
+	srv, conns := newCountingServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		serveSecurePackument(w, r)
+	})
+	cfg := useTestConfig(t)
+	cfg.Set("cafile", writeCertPEM(t, srv))
+	cfg.Set("maxsockets", "4")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := pkg.HttpClient.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if n := conns.Load(); n > 4 {
+		t.Errorf("Expected at most maxsockets=4 connections, got %d", n)
+	}
+}
+
+// benchmarkClient fetches a document from many goroutines at once, each
+// pausing between requests like a parallel install does, and reports the
+// connections opened per request.
+func benchmarkClient(b *testing.B, http2 bool, client func(srv *httptest.Server) *http.Client) {
+	// Each response takes a moment, like a registry across the network
+	srv, conns := newCountingServer(b, http2, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		serveSecurePackument(w, r)
+	})
+	c := client(srv)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := c.Get(srv.URL)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			// Extracting or resolving before the next request leaves the
+			// connection idle for a while
+			time.Sleep(time.Millisecond)
+		}
+	})
+	b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+}
+
+// untunedClient is the client snpm used before, http.DefaultTransport,
+// trusting the test server.
+func untunedClient(srv *httptest.Server) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	return &http.Client{Transport: t}
+}
+
+func tunedClient(b *testing.B) func(srv *httptest.Server) *http.Client {
+	return func(srv *httptest.Server) *http.Client {
+		cfg := useTestConfig(b)
+		cfg.Set("cafile", writeCertPEM(b, srv))
+		return pkg.HttpClient
+	}
+}
+
+func BenchmarkDefaultTransportHTTP1(b *testing.B) {
+	benchmarkClient(b, false, untunedClient)
+}
+
+func BenchmarkTunedTransportHTTP1(b *testing.B) {
+	benchmarkClient(b, false, tunedClient(b))
+}
+
+func BenchmarkTunedTransportHTTP2(b *testing.B) {
+	benchmarkClient(b, true, tunedClient(b))
+}